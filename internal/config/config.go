@@ -26,6 +26,11 @@ func LoadLabelifyConfig(path string) (*domain.Config, error) {
 		return nil, err
 	}
 
+	if err := validateConfig(&config); err != nil {
+		log.Printf("Error validating config: %v", err)
+		return nil, err
+	}
+
 	log.Printf("Config loaded successfully. Total sources: %d, Total rules: %d",
 		len(config.Sources), len(config.Enrichment.Rules))
 
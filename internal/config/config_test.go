@@ -0,0 +1,217 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadLabelifyConfig(t *testing.T) {
+	t.Run("given a rule with a valid aggregation", func(t *testing.T) {
+		path := writeConfig(t, `
+enrichment:
+  rules:
+    - match:
+        metric: "container_memory_working_set_bytes"
+        label: "pod"
+      enrich_from: static_map
+      add_labels:
+        - team
+      aggregation: max
+`)
+
+		config, err := LoadLabelifyConfig(path)
+
+		t.Run("then it should load the config", func(t *testing.T) {
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.Enrichment.Rules[0].Aggregation != "max" {
+				t.Fatalf("expected aggregation max, got %q", config.Enrichment.Rules[0].Aggregation)
+			}
+		})
+	})
+
+	t.Run("given a rule with an unknown aggregation", func(t *testing.T) {
+		path := writeConfig(t, `
+enrichment:
+  rules:
+    - match:
+        metric: "container_memory_working_set_bytes"
+        label: "pod"
+      enrich_from: static_map
+      add_labels:
+        - team
+      aggregation: median
+`)
+
+		_, err := LoadLabelifyConfig(path)
+
+		t.Run("then it should return an error", func(t *testing.T) {
+			if err == nil {
+				t.Fatal("expected an error, got nil")
+			}
+		})
+	})
+
+	t.Run("given a source with ordered mappings", func(t *testing.T) {
+		path := writeConfig(t, `
+sources:
+  - name: static_map
+    type: yaml
+    match_mode: full
+    precedence: longest_literal
+    mappings:
+      prometheus-.*:
+        labels:
+          team: observability
+      prometheus-grafana:
+        labels:
+          team: dashboards
+`)
+
+		config, err := LoadLabelifyConfig(path)
+
+		t.Run("then it should load the mappings in order", func(t *testing.T) {
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			source := config.Sources[0]
+			if source.MatchMode != "full" || source.Precedence != "longest_literal" {
+				t.Fatalf("expected full match mode and longest_literal precedence, got %q and %q", source.MatchMode, source.Precedence)
+			}
+			if len(source.Mappings) != 2 || source.Mappings[0].Pattern != "prometheus-.*" || source.Mappings[1].Pattern != "prometheus-grafana" {
+				t.Fatalf("expected mappings in declaration order, got %+v", source.Mappings)
+			}
+		})
+	})
+
+	t.Run("given a source with an unknown precedence", func(t *testing.T) {
+		path := writeConfig(t, `
+sources:
+  - name: static_map
+    type: yaml
+    precedence: random
+`)
+
+		_, err := LoadLabelifyConfig(path)
+
+		t.Run("then it should return an error", func(t *testing.T) {
+			if err == nil {
+				t.Fatal("expected an error, got nil")
+			}
+		})
+	})
+	t.Run("given a rule with an invalid template", func(t *testing.T) {
+		path := writeConfig(t, `
+enrichment:
+  rules:
+    - match:
+        metric: kube_deployment_spec_replicas
+        label: deployment
+      enrich_from: static_map
+      add_labels:
+        - team
+      fallback:
+        team: "unowned-{{ .namespace "
+`)
+
+		_, err := LoadLabelifyConfig(path)
+
+		t.Run("then it should return an error", func(t *testing.T) {
+			if err == nil {
+				t.Fatal("expected an error, got nil")
+			}
+		})
+	})
+	t.Run("given a rule with an invalid when", func(t *testing.T) {
+		path := writeConfig(t, `
+enrichment:
+  rules:
+    - match:
+        metric: kube_deployment_spec_replicas
+        label: deployment
+      enrich_from: static_map
+      add_labels:
+        - team
+      when: namespace = "kube-system"
+`)
+
+		_, err := LoadLabelifyConfig(path)
+
+		t.Run("then it should return an error", func(t *testing.T) {
+			if err == nil {
+				t.Fatal("expected an error, got nil")
+			}
+		})
+	})
+	t.Run("given a rule with an unknown relabel action", func(t *testing.T) {
+		path := writeConfig(t, `
+enrichment:
+  rules:
+    - match:
+        metric: kube_deployment_spec_replicas
+        label: deployment
+      enrich_from: static_map
+      add_labels:
+        - team
+      relabel_configs:
+        - source_labels: [namespace]
+          action: shuffle
+`)
+
+		_, err := LoadLabelifyConfig(path)
+
+		t.Run("then it should return an error", func(t *testing.T) {
+			if err == nil {
+				t.Fatal("expected an error, got nil")
+			}
+		})
+	})
+	t.Run("given a mapping keyed on an invalid selector", func(t *testing.T) {
+		path := writeConfig(t, `
+sources:
+  - name: static_map
+    type: yaml
+    mappings:
+      '{namespace="payments", deployment=~"api.*"':
+        labels:
+          team: payments
+`)
+
+		_, err := LoadLabelifyConfig(path)
+
+		t.Run("then it should return an error", func(t *testing.T) {
+			if err == nil {
+				t.Fatal("expected an error, got nil")
+			}
+		})
+	})
+	t.Run("given a source weighted from an unknown source", func(t *testing.T) {
+		path := writeConfig(t, `
+sources:
+  - name: static_map
+    type: yaml
+    weights_from: ratios
+`)
+
+		_, err := LoadLabelifyConfig(path)
+
+		t.Run("then it should return an error", func(t *testing.T) {
+			if err == nil {
+				t.Fatal("expected an error, got nil")
+			}
+		})
+	})
+}
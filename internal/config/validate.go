@@ -0,0 +1,73 @@
+package config
+
+import (
+	"fmt"
+
+	"github.com/lucianocarvalho/labelify/internal/domain"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+func validateConfig(config *domain.Config) error {
+	sources := make(map[string]bool, len(config.Sources))
+	for _, source := range config.Sources {
+		sources[source.Name] = true
+	}
+
+	for _, source := range config.Sources {
+		if source.WeightsFrom != "" && !sources[source.WeightsFrom] {
+			return fmt.Errorf("source %s: unknown weights_from source %s", source.Name, source.WeightsFrom)
+		}
+		if source.MatchMode != "" && !source.MatchMode.IsValid() {
+			return fmt.Errorf("source %s: invalid match_mode %q", source.Name, source.MatchMode)
+		}
+		if source.Precedence != "" && !source.Precedence.IsValid() {
+			return fmt.Errorf("source %s: invalid precedence %q", source.Name, source.Precedence)
+		}
+		for _, mapping := range source.Mappings {
+			for _, target := range mapping.Targets {
+				if target.Weight != nil && *target.Weight < 0 {
+					return fmt.Errorf("source %s: negative weight %v in mapping %s", source.Name, *target.Weight, mapping.Pattern)
+				}
+			}
+			if !mapping.IsSelector() {
+				continue
+			}
+			if _, err := parser.ParseMetricSelector(mapping.Pattern); err != nil {
+				return fmt.Errorf("source %s: invalid selector %s: %w", source.Name, mapping.Pattern, err)
+			}
+		}
+	}
+
+	for i, rule := range config.Enrichment.Rules {
+		if rule.Aggregation != "" && !rule.Aggregation.IsValid() {
+			return fmt.Errorf("rule %d (%s): invalid aggregation %q", i, rule.Match.Metric, rule.Aggregation)
+		}
+		if rule.Mode != "" && !rule.Mode.IsValid() {
+			return fmt.Errorf("rule %d (%s): invalid mode %q", i, rule.Match.Metric, rule.Mode)
+		}
+		if rule.Match.Extract != "" && !rule.Match.Extract.IsValid() {
+			return fmt.Errorf("rule %d (%s): invalid extract %q", i, rule.Match.Metric, rule.Match.Extract)
+		}
+		for _, label := range rule.Match.Labels {
+			if label.Extract != "" && !label.Extract.IsValid() {
+				return fmt.Errorf("rule %d (%s): invalid extract %q of label %s", i, rule.Match.Metric, label.Extract, label.Label)
+			}
+		}
+		if rule.When != "" {
+			if _, err := domain.ParseCondition(rule.When); err != nil {
+				return fmt.Errorf("rule %d (%s): invalid when: %w", i, rule.Match.Metric, err)
+			}
+		}
+		for _, label := range rule.AddLabels {
+			if _, err := domain.ParseTemplate(label.Name, label.Value); err != nil {
+				return fmt.Errorf("rule %d (%s): invalid value of label %s: %w", i, rule.Match.Metric, label.Name, err)
+			}
+		}
+		for label, value := range rule.Fallback {
+			if _, err := domain.ParseTemplate(label, value); err != nil {
+				return fmt.Errorf("rule %d (%s): invalid fallback of label %s: %w", i, rule.Match.Metric, label, err)
+			}
+		}
+	}
+	return nil
+}
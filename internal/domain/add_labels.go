@@ -0,0 +1,66 @@
+package domain
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"gopkg.in/yaml.v3"
+)
+
+func (a *AddLabels) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind != yaml.SequenceNode {
+		return fmt.Errorf("line %d: add_labels must be a list", node.Line)
+	}
+
+	labels := make(AddLabels, 0, len(node.Content))
+	for _, item := range node.Content {
+		switch {
+		case item.Kind == yaml.ScalarNode:
+			labels = append(labels, AddLabel{Name: item.Value})
+		case item.Kind == yaml.MappingNode && len(item.Content) == 2:
+			var value string
+			if err := item.Content[1].Decode(&value); err != nil {
+				return fmt.Errorf("error decoding label %s: %w", item.Content[0].Value, err)
+			}
+			labels = append(labels, AddLabel{Name: item.Content[0].Value, Value: value})
+		default:
+			return fmt.Errorf("line %d: labels must be a name or a single name to value map", item.Line)
+		}
+	}
+
+	*a = labels
+	return nil
+}
+
+func (a *AddLabels) UnmarshalJSON(data []byte) error {
+	if bytes.Equal(bytes.TrimSpace(data), []byte("null")) {
+		*a = nil
+		return nil
+	}
+
+	var items []json.RawMessage
+	if err := json.Unmarshal(data, &items); err != nil {
+		return err
+	}
+
+	labels := make(AddLabels, 0, len(items))
+	for _, item := range items {
+		var name string
+		if err := json.Unmarshal(item, &name); err == nil {
+			labels = append(labels, AddLabel{Name: name})
+			continue
+		}
+
+		var values map[string]string
+		if err := json.Unmarshal(item, &values); err != nil || len(values) != 1 {
+			return fmt.Errorf("labels must be a name or a single name to value map")
+		}
+		for name, value := range values {
+			labels = append(labels, AddLabel{Name: name, Value: value})
+		}
+	}
+
+	*a = labels
+	return nil
+}
@@ -0,0 +1,61 @@
+package domain
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestAddLabels_Unmarshal(t *testing.T) {
+	expected := AddLabels{
+		{Name: "team"},
+		{Name: "owner", Value: "{{ .Mapping.team | upper }}"},
+	}
+
+	t.Run("given YAML labels with and without a value", func(t *testing.T) {
+		var labels AddLabels
+		err := yaml.Unmarshal([]byte(`
+- team
+- owner: "{{ .Mapping.team | upper }}"
+`), &labels)
+
+		t.Run("then it should decode both forms", func(t *testing.T) {
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(labels, expected) {
+				t.Fatalf("expected %+v, got %+v", expected, labels)
+			}
+		})
+	})
+
+	t.Run("given JSON labels with and without a value", func(t *testing.T) {
+		var labels AddLabels
+		err := json.Unmarshal([]byte(`["team", {"owner": "{{ .Mapping.team | upper }}"}]`), &labels)
+
+		t.Run("then it should decode both forms", func(t *testing.T) {
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(labels, expected) {
+				t.Fatalf("expected %+v, got %+v", expected, labels)
+			}
+		})
+	})
+
+	t.Run("given a label with several names", func(t *testing.T) {
+		var labels AddLabels
+		err := yaml.Unmarshal([]byte(`
+- team: a
+  owner: b
+`), &labels)
+
+		t.Run("then it should return an error", func(t *testing.T) {
+			if err == nil {
+				t.Fatal("expected an error, got nil")
+			}
+		})
+	})
+}
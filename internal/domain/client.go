@@ -0,0 +1,8 @@
+package domain
+
+import "context"
+
+// QueryClient runs queries against the upstream Prometheus.
+type QueryClient interface {
+	Query(ctx context.Context, request QueryRequest) (*QueryResponse, error)
+}
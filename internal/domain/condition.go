@@ -0,0 +1,388 @@
+package domain
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Condition is a boolean expression over the labels of a series, eg:
+// `namespace != "kube-system" and (cluster in ["eu-1", "eu-2"] or not has(env))`.
+//
+// Labels are compared just like PromQL matchers do: missing labels are
+// empty (so `has` tells whether a label is set to a non-empty value), and
+// regexes must match the whole value.
+type Condition interface {
+	Matches(labels map[string]string) bool
+	// Labels returns the names of the labels the condition depends on.
+	Labels() []string
+}
+
+// ParseCondition parses a condition made of:
+//   - comparisons: `label == "value"`, `!=`, `=~ "regex"` and `!~`
+//   - lists: `label in ["a", "b"]` and `label not in ["a", "b"]`
+//   - presence checks: `has(label)`
+//   - `and`, `or`, `not` and parentheses
+func ParseCondition(expr string) (Condition, error) {
+	tokens, err := lexCondition(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &conditionParser{tokens: tokens}
+	cond, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if token := p.peek(); token.kind != tokenEOF {
+		return nil, fmt.Errorf("position %d: unexpected %s", token.pos, token)
+	}
+	return cond, nil
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenString
+	tokenOperator
+	tokenPunct
+)
+
+type conditionToken struct {
+	kind  tokenKind
+	value string
+	pos   int
+}
+
+func (t conditionToken) String() string {
+	switch t.kind {
+	case tokenEOF:
+		return "end of condition"
+	case tokenString:
+		return strconv.Quote(t.value)
+	default:
+		return fmt.Sprintf("%q", t.value)
+	}
+}
+
+func lexCondition(expr string) ([]conditionToken, error) {
+	var tokens []conditionToken
+
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(' || c == ')' || c == '[' || c == ']' || c == ',':
+			tokens = append(tokens, conditionToken{kind: tokenPunct, value: string(c), pos: i})
+			i++
+		case strings.HasPrefix(expr[i:], "=="), strings.HasPrefix(expr[i:], "!="),
+			strings.HasPrefix(expr[i:], "=~"), strings.HasPrefix(expr[i:], "!~"):
+			tokens = append(tokens, conditionToken{kind: tokenOperator, value: expr[i : i+2], pos: i})
+			i += 2
+		case c == '"' || c == '\'':
+			end := i + 1
+			for end < len(expr) && expr[end] != c {
+				if expr[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(expr) {
+				return nil, fmt.Errorf("position %d: unterminated string", i)
+			}
+
+			unquote := strconv.Unquote
+			if c == '\'' {
+				unquote = unquoteSingle
+			}
+			value, err := unquote(expr[i : end+1])
+			if err != nil {
+				return nil, fmt.Errorf("position %d: invalid string %s", i, expr[i:end+1])
+			}
+
+			tokens = append(tokens, conditionToken{kind: tokenString, value: value, pos: i})
+			i = end + 1
+		case c == '_' || unicode.IsLetter(rune(c)):
+			end := i
+			for end < len(expr) && (expr[end] == '_' || unicode.IsLetter(rune(expr[end])) || unicode.IsDigit(rune(expr[end]))) {
+				end++
+			}
+			tokens = append(tokens, conditionToken{kind: tokenIdent, value: expr[i:end], pos: i})
+			i = end
+		default:
+			return nil, fmt.Errorf("position %d: unexpected character %q", i, c)
+		}
+	}
+
+	return append(tokens, conditionToken{kind: tokenEOF, pos: len(expr)}), nil
+}
+
+// unquoteSingle unquotes a single-quoted string, which supports the same
+// escapes as double-quoted ones, `\'` and `\"` included.
+func unquoteSingle(quoted string) (string, error) {
+	s := quoted[1 : len(quoted)-1]
+
+	var b strings.Builder
+	for len(s) > 0 {
+		if strings.HasPrefix(s, `\"`) {
+			b.WriteByte('"')
+			s = s[2:]
+			continue
+		}
+
+		r, multibyte, tail, err := strconv.UnquoteChar(s, '\'')
+		if err != nil {
+			return "", err
+		}
+		if r < utf8.RuneSelf || !multibyte {
+			b.WriteByte(byte(r))
+		} else {
+			b.WriteRune(r)
+		}
+		s = tail
+	}
+	return b.String(), nil
+}
+
+type conditionParser struct {
+	tokens []conditionToken
+	pos    int
+}
+
+func (p *conditionParser) peek() conditionToken {
+	return p.tokens[p.pos]
+}
+
+func (p *conditionParser) next() conditionToken {
+	token := p.tokens[p.pos]
+	if token.kind != tokenEOF {
+		p.pos++
+	}
+	return token
+}
+
+func (p *conditionParser) accept(kind tokenKind, value string) bool {
+	if token := p.peek(); token.kind == kind && token.value == value {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *conditionParser) expect(kind tokenKind, value string) error {
+	if token := p.peek(); !p.accept(kind, value) {
+		return fmt.Errorf("position %d: expected %q, got %s", token.pos, value, token)
+	}
+	return nil
+}
+
+func (p *conditionParser) parseOr() (Condition, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept(tokenIdent, "or") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orCondition{left, right}
+	}
+	return left, nil
+}
+
+func (p *conditionParser) parseAnd() (Condition, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept(tokenIdent, "and") {
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = andCondition{left, right}
+	}
+	return left, nil
+}
+
+func (p *conditionParser) parseUnary() (Condition, error) {
+	if p.accept(tokenIdent, "not") {
+		cond, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notCondition{cond}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *conditionParser) parsePrimary() (Condition, error) {
+	if p.accept(tokenPunct, "(") {
+		cond, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(tokenPunct, ")"); err != nil {
+			return nil, err
+		}
+		return cond, nil
+	}
+
+	token := p.next()
+	if token.kind != tokenIdent {
+		return nil, fmt.Errorf("position %d: expected a label, got %s", token.pos, token)
+	}
+	label := token.value
+
+	// `has` is only a function when called, so it can still be a label name.
+	if label == "has" && p.accept(tokenPunct, "(") {
+		name := p.next()
+		if name.kind != tokenIdent {
+			return nil, fmt.Errorf("position %d: expected a label, got %s", name.pos, name)
+		}
+		if err := p.expect(tokenPunct, ")"); err != nil {
+			return nil, err
+		}
+		return hasCondition{name.value}, nil
+	}
+
+	if p.accept(tokenIdent, "in") {
+		return p.parseList(label, false)
+	}
+	if p.accept(tokenIdent, "not") {
+		if err := p.expect(tokenIdent, "in"); err != nil {
+			return nil, err
+		}
+		return p.parseList(label, true)
+	}
+
+	op := p.next()
+	if op.kind != tokenOperator {
+		return nil, fmt.Errorf("position %d: expected an operator after %s, got %s", op.pos, label, op)
+	}
+	value := p.next()
+	if value.kind != tokenString {
+		return nil, fmt.Errorf("position %d: expected a string, got %s", value.pos, value)
+	}
+
+	switch op.value {
+	case "==", "!=":
+		return equalCondition{label: label, value: value.value, negate: op.value == "!="}, nil
+	default:
+		re, err := regexp.Compile("^(?:" + value.value + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("position %d: invalid regex: %w", value.pos, err)
+		}
+		return regexCondition{label: label, re: re, negate: op.value == "!~"}, nil
+	}
+}
+
+func (p *conditionParser) parseList(label string, negate bool) (Condition, error) {
+	open := p.next()
+	if open.kind != tokenPunct || (open.value != "[" && open.value != "(") {
+		return nil, fmt.Errorf("position %d: expected a list, got %s", open.pos, open)
+	}
+	closing := "]"
+	if open.value == "(" {
+		closing = ")"
+	}
+
+	values := make(map[string]bool)
+	for !p.accept(tokenPunct, closing) {
+		if len(values) > 0 {
+			if err := p.expect(tokenPunct, ","); err != nil {
+				return nil, err
+			}
+		}
+		value := p.next()
+		if value.kind != tokenString {
+			return nil, fmt.Errorf("position %d: expected a string, got %s", value.pos, value)
+		}
+		values[value.value] = true
+	}
+
+	return inCondition{label: label, values: values, negate: negate}, nil
+}
+
+type equalCondition struct {
+	label  string
+	value  string
+	negate bool
+}
+
+func (c equalCondition) Matches(labels map[string]string) bool {
+	return (labels[c.label] == c.value) != c.negate
+}
+
+func (c equalCondition) Labels() []string { return []string{c.label} }
+
+type regexCondition struct {
+	label  string
+	re     *regexp.Regexp
+	negate bool
+}
+
+func (c regexCondition) Matches(labels map[string]string) bool {
+	return c.re.MatchString(labels[c.label]) != c.negate
+}
+
+func (c regexCondition) Labels() []string { return []string{c.label} }
+
+type inCondition struct {
+	label  string
+	values map[string]bool
+	negate bool
+}
+
+func (c inCondition) Matches(labels map[string]string) bool {
+	return c.values[labels[c.label]] != c.negate
+}
+
+func (c inCondition) Labels() []string { return []string{c.label} }
+
+type hasCondition struct {
+	label string
+}
+
+func (c hasCondition) Matches(labels map[string]string) bool {
+	return labels[c.label] != ""
+}
+
+func (c hasCondition) Labels() []string { return []string{c.label} }
+
+type notCondition struct {
+	cond Condition
+}
+
+func (c notCondition) Matches(labels map[string]string) bool {
+	return !c.cond.Matches(labels)
+}
+
+func (c notCondition) Labels() []string { return c.cond.Labels() }
+
+type andCondition struct {
+	left, right Condition
+}
+
+func (c andCondition) Matches(labels map[string]string) bool {
+	return c.left.Matches(labels) && c.right.Matches(labels)
+}
+
+func (c andCondition) Labels() []string { return append(c.left.Labels(), c.right.Labels()...) }
+
+type orCondition struct {
+	left, right Condition
+}
+
+func (c orCondition) Matches(labels map[string]string) bool {
+	return c.left.Matches(labels) || c.right.Matches(labels)
+}
+
+func (c orCondition) Labels() []string { return append(c.left.Labels(), c.right.Labels()...) }
@@ -0,0 +1,98 @@
+package domain
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCondition(t *testing.T) {
+	labels := map[string]string{"namespace": "default", "cluster": "eu-1", "deployment": "billing-api"}
+
+	testCases := []struct {
+		expr     string
+		expected bool
+	}{
+		{expr: `namespace != "kube-system"`, expected: true},
+		{expr: `namespace == "kube-system"`, expected: false},
+		{expr: `deployment =~ "billing-.*"`, expected: true},
+		{expr: `deployment =~ "billing"`, expected: false},
+		{expr: `deployment !~ 'billing-.*'`, expected: false},
+		{expr: `cluster in ["eu-1", "eu-2"]`, expected: true},
+		{expr: `cluster not in ("eu-1")`, expected: false},
+		{expr: `has(cluster) and not has(env)`, expected: true},
+		{expr: `env == ""`, expected: true},
+		{expr: `namespace == "kube-system" or cluster == "eu-1" and deployment != ""`, expected: true},
+		{expr: `(namespace == "kube-system" or cluster == "eu-1") and deployment == ""`, expected: false},
+		{expr: `not (cluster == "us-1")`, expected: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run("given the condition "+tc.expr, func(t *testing.T) {
+			cond, err := ParseCondition(tc.expr)
+
+			t.Run("then it should evaluate it against the labels", func(t *testing.T) {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if matched := cond.Matches(labels); matched != tc.expected {
+					t.Fatalf("expected %v, got %v", tc.expected, matched)
+				}
+			})
+		})
+	}
+
+	quoted := map[string]string{"owner": `it's "ours"`, "path": `C:\temp`}
+	for _, expr := range []string{
+		`owner == 'it\'s "ours"'`,
+		`owner == 'it\'s \"ours\"'`,
+		`owner == "it's \"ours\""`,
+		`path == 'C:\\temp'`,
+	} {
+		t.Run("given the condition "+expr, func(t *testing.T) {
+			cond, err := ParseCondition(expr)
+
+			t.Run("then it should unescape both kinds of quote", func(t *testing.T) {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !cond.Matches(quoted) {
+					t.Fatalf("expected %s to match %v", expr, quoted)
+				}
+			})
+		})
+	}
+
+	t.Run("given a condition on several labels", func(t *testing.T) {
+		cond, err := ParseCondition(`namespace != "kube-system" and (cluster in ["eu-1"] or not has(env))`)
+
+		t.Run("then it should list the labels it depends on", func(t *testing.T) {
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := []string{"namespace", "cluster", "env"}
+			if !reflect.DeepEqual(cond.Labels(), expected) {
+				t.Fatalf("expected %v, got %v", expected, cond.Labels())
+			}
+		})
+	})
+
+	for _, expr := range []string{
+		`namespace = "default"`,
+		`namespace == default`,
+		`namespace == "default" and`,
+		`(namespace == "default"`,
+		`cluster in ["eu-1" "eu-2"]`,
+		`deployment =~ "billing-("`,
+		`namespace == "default`,
+	} {
+		t.Run("given the invalid condition "+expr, func(t *testing.T) {
+			_, err := ParseCondition(expr)
+
+			t.Run("then it should return an error", func(t *testing.T) {
+				if err == nil {
+					t.Fatal("expected an error, got nil")
+				}
+			})
+		})
+	}
+}
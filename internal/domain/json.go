@@ -0,0 +1,121 @@
+package domain
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+)
+
+func (r *QueryResponse) UnmarshalJSON(data []byte) error {
+	type queryResponse QueryResponse
+	return unmarshalWithExtra(data, (*queryResponse)(r), &r.Extra)
+}
+
+func (r QueryResponse) MarshalJSON() ([]byte, error) {
+	type queryResponse QueryResponse
+	return marshalWithExtra(queryResponse(r), r.Extra)
+}
+
+func (d *QueryData) UnmarshalJSON(data []byte) error {
+	type queryData QueryData
+	return unmarshalWithExtra(data, (*queryData)(d), &d.Extra)
+}
+
+func (d QueryData) MarshalJSON() ([]byte, error) {
+	type queryData QueryData
+	return marshalWithExtra(queryData(d), d.Extra)
+}
+
+func (d *MetricData) UnmarshalJSON(data []byte) error {
+	type metricData MetricData
+	return unmarshalWithExtra(data, (*metricData)(d), &d.Extra)
+}
+
+func (d MetricData) MarshalJSON() ([]byte, error) {
+	type metricData MetricData
+	return marshalWithExtra(metricData(d), d.Extra)
+}
+
+func (r *LabelsResponse) UnmarshalJSON(data []byte) error {
+	type labelsResponse LabelsResponse
+	return unmarshalWithExtra(data, (*labelsResponse)(r), &r.Extra)
+}
+
+func (r LabelsResponse) MarshalJSON() ([]byte, error) {
+	type labelsResponse LabelsResponse
+	return marshalWithExtra(labelsResponse(r), r.Extra)
+}
+
+func (r *SeriesResponse) UnmarshalJSON(data []byte) error {
+	type seriesResponse SeriesResponse
+	return unmarshalWithExtra(data, (*seriesResponse)(r), &r.Extra)
+}
+
+func (r SeriesResponse) MarshalJSON() ([]byte, error) {
+	type seriesResponse SeriesResponse
+	return marshalWithExtra(seriesResponse(r), r.Extra)
+}
+
+// unmarshalWithExtra decodes data into v and keeps every field that v
+// does not know about in extra, so it can be written back later.
+func unmarshalWithExtra(data []byte, v interface{}, extra *map[string]json.RawMessage) error {
+	if err := json.Unmarshal(data, v); err != nil {
+		return err
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+
+	for _, name := range jsonFieldNames(v) {
+		delete(fields, name)
+	}
+
+	if len(fields) == 0 {
+		fields = nil
+	}
+	*extra = fields
+
+	return nil
+}
+
+func marshalWithExtra(v interface{}, extra map[string]json.RawMessage) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil || len(extra) == 0 {
+		return data, err
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+
+	for name, value := range extra {
+		if _, ok := fields[name]; !ok {
+			fields[name] = value
+		}
+	}
+
+	return json.Marshal(fields)
+}
+
+func jsonFieldNames(v interface{}) []string {
+	t := reflect.TypeOf(v)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	names := make([]string, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = t.Field(i).Name
+		}
+		names = append(names, name)
+	}
+	return names
+}
@@ -0,0 +1,106 @@
+package domain
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestQueryResponse_JSON(t *testing.T) {
+	t.Run("given a response with every field Prometheus returns", func(t *testing.T) {
+		original := `{
+			"status": "success",
+			"data": {
+				"resultType": "vector",
+				"result": [
+					{"metric": {"deployment": "coredns"}, "value": [182778586, "1"]}
+				],
+				"stats": {"timings": {"evalTotalTime": 0.0001}, "samples": {"totalQueryableSamples": 4}},
+				"futureDataField": true
+			},
+			"warnings": ["some warning"],
+			"infos": ["some info"],
+			"futureField": {"nested": [1, 2, 3]}
+		}`
+
+		var response QueryResponse
+		if err := json.Unmarshal([]byte(original), &response); err != nil {
+			t.Fatal(err)
+		}
+
+		marshaled, err := json.Marshal(response)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		t.Run("then it should round-trip all fields, including unknown ones", func(t *testing.T) {
+			var expected, result interface{}
+			_ = json.Unmarshal([]byte(original), &expected)
+			_ = json.Unmarshal(marshaled, &result)
+
+			if !reflect.DeepEqual(result, expected) {
+				t.Fatalf("expected %s, got %s", original, marshaled)
+			}
+		})
+	})
+
+	t.Run("given a series with an unknown field", func(t *testing.T) {
+		original := `{
+			"status": "success",
+			"data": {
+				"resultType": "vector",
+				"result": [
+					{"metric": {"deployment": "coredns"}, "value": [182778586, "1"], "futureSeriesField": {"nested": "value"}}
+				]
+			}
+		}`
+
+		var response QueryResponse
+		if err := json.Unmarshal([]byte(original), &response); err != nil {
+			t.Fatal(err)
+		}
+
+		marshaled, err := json.Marshal(response)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		t.Run("then it should keep it as an extra field of the series", func(t *testing.T) {
+			expected := map[string]json.RawMessage{"futureSeriesField": json.RawMessage(`{"nested": "value"}`)}
+			if !reflect.DeepEqual(response.Data.Result[0].Extra, expected) {
+				t.Fatalf("expected %s, got %s", expected, response.Data.Result[0].Extra)
+			}
+		})
+
+		t.Run("then it should round-trip it", func(t *testing.T) {
+			var expected, result interface{}
+			_ = json.Unmarshal([]byte(original), &expected)
+			_ = json.Unmarshal(marshaled, &result)
+
+			if !reflect.DeepEqual(result, expected) {
+				t.Fatalf("expected %s, got %s", original, marshaled)
+			}
+		})
+	})
+
+	t.Run("given an error response", func(t *testing.T) {
+		original := `{"status": "error", "errorType": "bad_data", "error": "invalid parameter \"query\"", "data": {"resultType": "", "result": null}}`
+
+		var response QueryResponse
+		if err := json.Unmarshal([]byte(original), &response); err != nil {
+			t.Fatal(err)
+		}
+
+		t.Run("then it should keep the error fields", func(t *testing.T) {
+			if response.ErrorType != "bad_data" || response.Error != `invalid parameter "query"` {
+				t.Fatalf("unexpected error fields: %+v", response)
+			}
+		})
+
+		t.Run("then it should not keep known fields as extra ones", func(t *testing.T) {
+			if response.Extra != nil {
+				t.Fatalf("expected no extra fields, got %+v", response.Extra)
+			}
+		})
+	})
+}
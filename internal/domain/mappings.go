@@ -0,0 +1,90 @@
+package domain
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"gopkg.in/yaml.v3"
+)
+
+// mappingValue is a mapping declared under its pattern key.
+type mappingValue struct {
+	SourceData `yaml:",inline"`
+	Priority   int `json:"priority,omitempty" yaml:"priority,omitempty"`
+}
+
+func (m *Mappings) UnmarshalYAML(node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.SequenceNode:
+		var list []Mapping
+		if err := node.Decode(&list); err != nil {
+			return err
+		}
+		*m = list
+		return nil
+	case yaml.MappingNode:
+		mappings := make(Mappings, 0, len(node.Content)/2)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			var value mappingValue
+			if err := node.Content[i+1].Decode(&value); err != nil {
+				return fmt.Errorf("error decoding mapping %s: %w", node.Content[i].Value, err)
+			}
+			mappings = append(mappings, Mapping{
+				Pattern:    node.Content[i].Value,
+				SourceData: value.SourceData,
+				Priority:   value.Priority,
+			})
+		}
+		*m = mappings
+		return nil
+	default:
+		return fmt.Errorf("line %d: mappings must be a map or a list", node.Line)
+	}
+}
+
+func (m *Mappings) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+
+	switch {
+	case bytes.Equal(data, []byte("null")):
+		*m = nil
+		return nil
+	case bytes.HasPrefix(data, []byte("[")):
+		var list []Mapping
+		if err := json.Unmarshal(data, &list); err != nil {
+			return err
+		}
+		*m = list
+		return nil
+	}
+
+	// A plain map would lose the order of the keys, so they're read one by one.
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return fmt.Errorf("mappings must be an object or an array")
+	}
+
+	mappings := make(Mappings, 0)
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		pattern, _ := token.(string)
+
+		var value mappingValue
+		if err := decoder.Decode(&value); err != nil {
+			return fmt.Errorf("error decoding mapping %s: %w", pattern, err)
+		}
+
+		mappings = append(mappings, Mapping{
+			Pattern:    pattern,
+			SourceData: value.SourceData,
+			Priority:   value.Priority,
+		})
+	}
+
+	*m = mappings
+	return nil
+}
@@ -0,0 +1,103 @@
+package domain
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestMappings_Unmarshal(t *testing.T) {
+	expected := Mappings{
+		{Pattern: "prometheus-grafana", SourceData: SourceData{Labels: map[string]string{"team": "dashboards"}}, Priority: 10},
+		{Pattern: "prometheus-.*", SourceData: SourceData{Labels: map[string]string{"team": "observability"}}},
+		{Pattern: "coredns", SourceData: SourceData{Labels: map[string]string{"team": "platform"}}},
+	}
+
+	t.Run("given YAML mappings keyed by pattern", func(t *testing.T) {
+		var mappings Mappings
+		err := yaml.Unmarshal([]byte(`
+prometheus-grafana:
+  labels:
+    team: dashboards
+  priority: 10
+prometheus-.*:
+  labels:
+    team: observability
+coredns:
+  labels:
+    team: platform
+`), &mappings)
+
+		t.Run("then it should keep the declaration order", func(t *testing.T) {
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(mappings, expected) {
+				t.Fatalf("expected %+v, got %+v", expected, mappings)
+			}
+		})
+	})
+
+	t.Run("given YAML mappings as a list", func(t *testing.T) {
+		var mappings Mappings
+		err := yaml.Unmarshal([]byte(`
+- pattern: prometheus-grafana
+  labels:
+    team: dashboards
+  priority: 10
+- pattern: prometheus-.*
+  labels:
+    team: observability
+- pattern: coredns
+  labels:
+    team: platform
+`), &mappings)
+
+		t.Run("then it should keep the declaration order", func(t *testing.T) {
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(mappings, expected) {
+				t.Fatalf("expected %+v, got %+v", expected, mappings)
+			}
+		})
+	})
+
+	t.Run("given JSON mappings keyed by pattern", func(t *testing.T) {
+		var mappings Mappings
+		err := json.Unmarshal([]byte(`{
+			"prometheus-grafana": {"labels": {"team": "dashboards"}, "priority": 10},
+			"prometheus-.*": {"labels": {"team": "observability"}},
+			"coredns": {"labels": {"team": "platform"}}
+		}`), &mappings)
+
+		t.Run("then it should keep the declaration order", func(t *testing.T) {
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(mappings, expected) {
+				t.Fatalf("expected %+v, got %+v", expected, mappings)
+			}
+		})
+	})
+
+	t.Run("given JSON mappings as an array", func(t *testing.T) {
+		var mappings Mappings
+		err := json.Unmarshal([]byte(`[
+			{"pattern": "prometheus-grafana", "labels": {"team": "dashboards"}, "priority": 10},
+			{"pattern": "prometheus-.*", "labels": {"team": "observability"}},
+			{"pattern": "coredns", "labels": {"team": "platform"}}
+		]`), &mappings)
+
+		t.Run("then it should keep the declaration order", func(t *testing.T) {
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(mappings, expected) {
+				t.Fatalf("expected %+v, got %+v", expected, mappings)
+			}
+		})
+	})
+}
@@ -0,0 +1,33 @@
+package domain
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"gopkg.in/yaml.v3"
+)
+
+func (m *MatchLabel) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*m = MatchLabel{Label: node.Value}
+		return nil
+	}
+
+	type matchLabel MatchLabel
+	return node.Decode((*matchLabel)(m))
+}
+
+func (m *MatchLabel) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if bytes.HasPrefix(data, []byte(`"`)) {
+		*m = MatchLabel{}
+		return json.Unmarshal(data, &m.Label)
+	}
+
+	type matchLabel MatchLabel
+	if err := json.Unmarshal(data, (*matchLabel)(m)); err != nil {
+		return fmt.Errorf("labels must be a name or a label map: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package domain
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestMatchLabels_Unmarshal(t *testing.T) {
+	expected := MatchLabels{
+		{Label: "deployment"},
+		{Label: "namespace", EnrichFrom: "namespaces"},
+	}
+
+	t.Run("given YAML labels as names and maps", func(t *testing.T) {
+		var labels MatchLabels
+		err := yaml.Unmarshal([]byte(`
+- deployment
+- label: namespace
+  enrich_from: namespaces
+`), &labels)
+
+		t.Run("then it should decode both forms", func(t *testing.T) {
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(labels, expected) {
+				t.Fatalf("expected %+v, got %+v", expected, labels)
+			}
+		})
+	})
+
+	t.Run("given JSON labels as names and objects", func(t *testing.T) {
+		var labels MatchLabels
+		err := json.Unmarshal([]byte(`["deployment", {"label": "namespace", "enrich_from": "namespaces"}]`), &labels)
+
+		t.Run("then it should decode both forms", func(t *testing.T) {
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(labels, expected) {
+				t.Fatalf("expected %+v, got %+v", expected, labels)
+			}
+		})
+	})
+}
@@ -1,5 +1,13 @@
 package domain
 
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/prometheus/model/relabel"
+)
+
 type Config struct {
 	Config     ServerConfig `json:"config" yaml:"config"`
 	Sources    []Source     `json:"sources" yaml:"sources"`
@@ -20,10 +28,43 @@ type PortConfig struct {
 }
 
 type Source struct {
-	Name     string                `json:"name" yaml:"name"`
-	Type     string                `json:"type" yaml:"type"`
-	Config   SourceConfig          `json:"config,omitempty" yaml:"config,omitempty"`
-	Mappings map[string]SourceData `json:"mappings,omitempty" yaml:"mappings,omitempty"`
+	Name       string       `json:"name" yaml:"name"`
+	Type       string       `json:"type" yaml:"type"`
+	Config     SourceConfig `json:"config,omitempty" yaml:"config,omitempty"`
+	MatchMode  MatchMode    `json:"match_mode,omitempty" yaml:"match_mode,omitempty"`
+	Precedence Precedence   `json:"precedence,omitempty" yaml:"precedence,omitempty"`
+	Mappings   Mappings     `json:"mappings,omitempty" yaml:"mappings,omitempty"`
+	// Source the weights of the mappings targets are taken from, eg: one
+	// kept up to date by a billing system.
+	WeightsFrom string `json:"weights_from,omitempty" yaml:"weights_from,omitempty"`
+}
+
+type MatchMode string
+
+const (
+	// Patterns match anywhere in the value, just like regexp.MatchString.
+	MatchModePartial MatchMode = "partial"
+	// Patterns must match the whole value, just like PromQL regex matchers.
+	MatchModeFull MatchMode = "full"
+)
+
+func (m MatchMode) IsValid() bool {
+	return m == MatchModePartial || m == MatchModeFull
+}
+
+type Precedence string
+
+const (
+	// The first matching mapping, in the order they are declared, wins.
+	PrecedenceFirst Precedence = "first"
+	// The matching mapping with the most literal characters wins.
+	PrecedenceLongestLiteral Precedence = "longest_literal"
+	// The matching mapping with the highest priority wins.
+	PrecedencePriority Precedence = "priority"
+)
+
+func (p Precedence) IsValid() bool {
+	return p == PrecedenceFirst || p == PrecedenceLongestLiteral || p == PrecedencePriority
 }
 
 type SourceConfig struct {
@@ -35,36 +76,242 @@ type SourceConfig struct {
 
 type SourceData struct {
 	Labels map[string]string `json:"labels" yaml:"labels"`
+	// Groups a matched series is fanned out to: it's duplicated into each
+	// of them, with the target labels added on top of Labels.
+	Targets []Target `json:"targets,omitempty" yaml:"targets,omitempty"`
 }
 
+type Target struct {
+	Labels map[string]string `json:"labels" yaml:"labels"`
+	// Share of the series values going to the target (eg: 0.6 for 60%),
+	// all of them when not set.
+	Weight *float64 `json:"weight,omitempty" yaml:"weight,omitempty"`
+}
+
+// LabelSets returns the labels of each target, or Labels alone when there
+// are no targets.
+func (d SourceData) LabelSets() []map[string]string {
+	if len(d.Targets) == 0 {
+		return []map[string]string{d.Labels}
+	}
+
+	sets := make([]map[string]string, 0, len(d.Targets))
+	for _, target := range d.Targets {
+		set := make(map[string]string, len(d.Labels)+len(target.Labels))
+		for name, value := range d.Labels {
+			set[name] = value
+		}
+		for name, value := range target.Labels {
+			set[name] = value
+		}
+		sets = append(sets, set)
+	}
+	return sets
+}
+
+type Mapping struct {
+	Pattern    string `json:"pattern" yaml:"pattern"`
+	SourceData `yaml:",inline"`
+	Priority   int `json:"priority,omitempty" yaml:"priority,omitempty"`
+}
+
+// IsSelector tells whether the mapping is keyed on a label selector (eg:
+// `{namespace="payments", deployment=~"api.*"}`), matched against the
+// whole series, instead of a pattern matched against the rule label.
+func (m Mapping) IsSelector() bool {
+	return strings.HasPrefix(strings.TrimSpace(m.Pattern), "{")
+}
+
+// Mappings keep the order they were declared in, either as a map keyed by
+// pattern or as a list of mappings.
+type Mappings []Mapping
+
 type Enrichment struct {
 	Rules []EnrichmentRule `json:"rules" yaml:"rules"`
 }
 
 type EnrichmentRule struct {
-	Match      MatchRule         `json:"match" yaml:"match"`
-	EnrichFrom string            `json:"enrich_from" yaml:"enrich_from"`
-	AddLabels  []string          `json:"add_labels" yaml:"add_labels"`
-	Fallback   map[string]string `json:"fallback" yaml:"fallback"`
+	Match       MatchRule         `json:"match" yaml:"match"`
+	EnrichFrom  string            `json:"enrich_from" yaml:"enrich_from"`
+	AddLabels   AddLabels         `json:"add_labels" yaml:"add_labels"`
+	Fallback    map[string]string `json:"fallback" yaml:"fallback"`
+	Aggregation Aggregation       `json:"aggregation,omitempty" yaml:"aggregation,omitempty"`
+	Mode        EnrichmentMode    `json:"mode,omitempty" yaml:"mode,omitempty"`
+	// Condition on the series labels for the rule to apply, eg:
+	// `namespace != "kube-system"`. See ParseCondition.
+	When string `json:"when,omitempty" yaml:"when,omitempty"`
+	// Prometheus relabel steps run on the enriched series, before they're
+	// aggregated.
+	RelabelConfigs []*relabel.Config `json:"relabel_configs,omitempty" yaml:"relabel_configs,omitempty"`
+}
+
+// AddLabel is a label added by a rule. Its value is taken from the matched
+// mapping labels, unless a value (which may be a template) is given.
+type AddLabel struct {
+	Name  string `json:"name" yaml:"name"`
+	Value string `json:"value,omitempty" yaml:"value,omitempty"`
+}
+
+// AddLabels are declared either as label names or as single-key maps of a
+// label name to its value, eg: `[team, owner: "{{ .Mapping.team }}"]`.
+type AddLabels []AddLabel
+
+func (a AddLabels) Names() []string {
+	names := make([]string, 0, len(a))
+	for _, label := range a {
+		names = append(names, label.Name)
+	}
+	return names
+}
+
+func (a AddLabels) Contains(name string) bool {
+	for _, label := range a {
+		if label.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+type EnrichmentMode string
+
+const (
+	// Series are grouped by the enriched labels.
+	EnrichmentModeAggregate EnrichmentMode = "aggregate"
+	// Enriched labels are appended to each series, keeping every other label.
+	EnrichmentModeKeep EnrichmentMode = "keep"
+)
+
+func (m EnrichmentMode) IsValid() bool {
+	return m == EnrichmentModeAggregate || m == EnrichmentModeKeep
+}
+
+type Aggregation string
+
+const (
+	AggregationSum   Aggregation = "sum"
+	AggregationMin   Aggregation = "min"
+	AggregationMax   Aggregation = "max"
+	AggregationCount Aggregation = "count"
+	AggregationAvg   Aggregation = "avg"
+	AggregationGroup Aggregation = "group"
+	AggregationLast  Aggregation = "last"
+)
+
+func (a Aggregation) IsValid() bool {
+	switch a {
+	case AggregationSum, AggregationMin, AggregationMax, AggregationCount, AggregationAvg, AggregationGroup, AggregationLast:
+		return true
+	default:
+		return false
+	}
 }
 
 type MatchRule struct {
 	Metric string `json:"metric" yaml:"metric"`
 	Label  string `json:"label" yaml:"label"`
+	// Labels to look up in order, instead of Label. The first one found in
+	// a mapping supplies the enriched labels.
+	Labels MatchLabels `json:"labels,omitempty" yaml:"labels,omitempty"`
+	// How the key looked up in the mappings is extracted from Label.
+	Extract KeyExtractor `json:"extract,omitempty" yaml:"extract,omitempty"`
 }
 
+// MatchLabel is a label looked up by a rule, either in the rule source or
+// in its own (eg: namespaces mapped in a different source than deployments).
+type MatchLabel struct {
+	Label      string       `json:"label" yaml:"label"`
+	EnrichFrom string       `json:"enrich_from,omitempty" yaml:"enrich_from,omitempty"`
+	Extract    KeyExtractor `json:"extract,omitempty" yaml:"extract,omitempty"`
+}
+
+type KeyExtractor string
+
+const (
+	// The owning Kubernetes workload name of a pod or a ReplicaSet, eg:
+	// `checkout` for `checkout-7d9f8c6b5-x2k9q`.
+	KeyExtractorWorkload KeyExtractor = "workload"
+)
+
+func (k KeyExtractor) IsValid() bool {
+	return k == KeyExtractorWorkload
+}
+
+// MatchLabels are declared either as label names or as MatchLabel maps.
+type MatchLabels []MatchLabel
+
 type QueryResponse struct {
-	Status string    `json:"status" yaml:"status"`
-	Data   QueryData `json:"data" yaml:"data"`
+	Status    string    `json:"status" yaml:"status"`
+	Data      QueryData `json:"data" yaml:"data"`
+	ErrorType string    `json:"errorType,omitempty" yaml:"error_type,omitempty"`
+	Error     string    `json:"error,omitempty" yaml:"error,omitempty"`
+	Warnings  []string  `json:"warnings,omitempty" yaml:"warnings,omitempty"`
+	Infos     []string  `json:"infos,omitempty" yaml:"infos,omitempty"`
+
+	// Fields unknown to Labelify, kept so they are sent back to the client.
+	Extra map[string]json.RawMessage `json:"-" yaml:"-"`
 }
 
 type QueryData struct {
-	ResultType string       `json:"resultType" yaml:"result_type"`
-	Result     []MetricData `json:"result" yaml:"result"`
+	ResultType string          `json:"resultType" yaml:"result_type"`
+	Result     []MetricData    `json:"result" yaml:"result"`
+	Stats      json.RawMessage `json:"stats,omitempty" yaml:"-"`
+
+	Extra map[string]json.RawMessage `json:"-" yaml:"-"`
 }
 
 type MetricData struct {
-	Metric map[string]string `json:"metric" yaml:"metric"`
-	Values [][]interface{}   `json:"values,omitempty" yaml:"values,omitempty"`
-	Value  []interface{}     `json:"value,omitempty" yaml:"value,omitempty"`
+	Metric     map[string]string `json:"metric" yaml:"metric"`
+	Values     [][]interface{}   `json:"values,omitempty" yaml:"values,omitempty"`
+	Value      []interface{}     `json:"value,omitempty" yaml:"value,omitempty"`
+	Histograms [][]interface{}   `json:"histograms,omitempty" yaml:"histograms,omitempty"`
+	Histogram  []interface{}     `json:"histogram,omitempty" yaml:"histogram,omitempty"`
+
+	Extra map[string]json.RawMessage `json:"-" yaml:"-"`
+}
+
+type QueryRequest struct {
+	Query   string
+	Time    string
+	Start   string
+	End     string
+	Step    string
+	Timeout string
+	// Whether the request targets /api/v1/query_range.
+	Range bool
+	Mode  EnrichmentMode
+	// Headers sent along upstream queries (eg: for authentication).
+	Header http.Header
+}
+
+type MetadataType string
+
+const (
+	MetadataTypeLabels      MetadataType = "labels"
+	MetadataTypeLabelValues MetadataType = "label_values"
+	MetadataTypeSeries      MetadataType = "series"
+)
+
+type MetadataRequest struct {
+	Type      MetadataType
+	LabelName string
+	Matchers  []string
+}
+
+type LabelsResponse struct {
+	Status   string   `json:"status" yaml:"status"`
+	Data     []string `json:"data" yaml:"data"`
+	Warnings []string `json:"warnings,omitempty" yaml:"warnings,omitempty"`
+	Infos    []string `json:"infos,omitempty" yaml:"infos,omitempty"`
+
+	Extra map[string]json.RawMessage `json:"-" yaml:"-"`
+}
+
+type SeriesResponse struct {
+	Status   string              `json:"status" yaml:"status"`
+	Data     []map[string]string `json:"data" yaml:"data"`
+	Warnings []string            `json:"warnings,omitempty" yaml:"warnings,omitempty"`
+	Infos    []string            `json:"infos,omitempty" yaml:"infos,omitempty"`
+
+	Extra map[string]json.RawMessage `json:"-" yaml:"-"`
 }
@@ -1,7 +1,9 @@
 package domain
 
 type SourceProvider interface {
-	GetMappings() (map[string]SourceData, error)
+	GetMappings() (Mappings, error)
+	// Revision changes every time the mappings are refreshed.
+	Revision() uint64
 	Name() string
 }
 
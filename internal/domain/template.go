@@ -0,0 +1,37 @@
+package domain
+
+import (
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+var templateFuncs = template.FuncMap{
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+	"trimPrefix": func(prefix, s string) string {
+		return strings.TrimPrefix(s, prefix)
+	},
+	"replace": func(old, new, s string) string {
+		return strings.ReplaceAll(s, old, new)
+	},
+	"default": func(def, value string) string {
+		if value != "" {
+			return value
+		}
+		return def
+	},
+	"regexReplace": func(expr, replacement, s string) (string, error) {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return "", err
+		}
+		return re.ReplaceAllString(s, replacement), nil
+	},
+}
+
+// ParseTemplate parses the template of an enriched label value, eg:
+// `unowned-{{ .namespace }}`.
+func ParseTemplate(name, text string) (*template.Template, error) {
+	return template.New(name).Option("missingkey=error").Funcs(templateFuncs).Parse(text)
+}
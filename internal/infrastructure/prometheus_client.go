@@ -0,0 +1,82 @@
+package infrastructure
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/lucianocarvalho/labelify/internal/domain"
+)
+
+type PrometheusClient struct {
+	target *url.URL
+	client *http.Client
+}
+
+// NewPrometheusClient creates a client sharing the given transport. Queries
+// are bounded by their context rather than by a client timeout.
+func NewPrometheusClient(target *url.URL, transport http.RoundTripper) *PrometheusClient {
+	return &PrometheusClient{
+		target: target,
+		client: &http.Client{Transport: transport},
+	}
+}
+
+func (c *PrometheusClient) Query(ctx context.Context, request domain.QueryRequest) (*domain.QueryResponse, error) {
+	path := "/api/v1/query"
+	if request.Range {
+		path = "/api/v1/query_range"
+	}
+
+	params := url.Values{}
+	params.Set("query", request.Query)
+	for key, value := range map[string]string{
+		"time":    request.Time,
+		"start":   request.Start,
+		"end":     request.End,
+		"step":    request.Step,
+		"timeout": request.Timeout,
+	} {
+		if value != "" {
+			params.Set(key, value)
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.target.JoinPath(path).String(), strings.NewReader(params.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %w", err)
+	}
+
+	// The headers of the proxied request are sent along (eg: for authentication).
+	req.Header = request.Header.Clone()
+	if req.Header == nil {
+		req.Header = http.Header{}
+	}
+	for _, key := range []string{"Connection", "Content-Length", "Content-Type", "Accept-Encoding"} {
+		req.Header.Del(key)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error making request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading response body: %w", err)
+	}
+
+	// Prometheus error responses have a body too, so they're returned as is.
+	var queryResponse domain.QueryResponse
+	if err := json.Unmarshal(body, &queryResponse); err != nil {
+		return nil, fmt.Errorf("error unmarshaling response (status code %d): %w", resp.StatusCode, err)
+	}
+
+	return &queryResponse, nil
+}
@@ -3,19 +3,39 @@ package infrastructure
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"log"
+	"mime"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/lucianocarvalho/labelify/internal/domain"
 	"github.com/lucianocarvalho/labelify/internal/usecase"
 )
 
+type requestKey struct{}
+
+// Status codes of Prometheus error responses, by error type.
+var errorStatusCodes = map[string]int{
+	"bad_data":    http.StatusBadRequest,
+	"execution":   http.StatusUnprocessableEntity,
+	"canceled":    http.StatusServiceUnavailable,
+	"timeout":     http.StatusServiceUnavailable,
+	"unavailable": http.StatusServiceUnavailable,
+	"not_found":   http.StatusNotFound,
+	"internal":    http.StatusInternalServerError,
+}
+
 type Proxy struct {
 	proxy      *httputil.ReverseProxy
+	client     *PrometheusClient
 	enrichment *usecase.EnrichmentUseCase
 }
 
@@ -25,10 +45,15 @@ func NewProxy(targetURL string, enrichment *usecase.EnrichmentUseCase) (*Proxy,
 		return nil, err
 	}
 
-	return &Proxy{
+	p := &Proxy{
 		proxy:      httputil.NewSingleHostReverseProxy(target),
+		client:     NewPrometheusClient(target, http.DefaultTransport),
 		enrichment: enrichment,
-	}, nil
+	}
+	p.proxy.Transport = http.DefaultTransport
+	p.proxy.ModifyResponse = p.modifyResponse
+
+	return p, nil
 }
 
 func (p *Proxy) setResponseBody(resp *http.Response, body []byte) {
@@ -37,7 +62,128 @@ func (p *Proxy) setResponseBody(resp *http.Response, body []byte) {
 	resp.Header.Set("Content-Length", fmt.Sprintf("%d", len(body)))
 }
 
-func (p *Proxy) modifyResponse(resp *http.Response) error {
+func (p *Proxy) parseParams(r *http.Request) (url.Values, error) {
+	params := r.URL.Query()
+
+	if r.Method != http.MethodPost || r.Body == nil {
+		return params, nil
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/x-www-form-urlencoded" {
+		return params, nil
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading request body: %w", err)
+	}
+	r.Body.Close()
+
+	// The body still has to be forwarded to Prometheus as is.
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return nil, fmt.Errorf("error parsing request body: %w", err)
+	}
+
+	// Body values take precedence over the URL ones.
+	for key, values := range params {
+		form[key] = append(form[key], values...)
+	}
+
+	return form, nil
+}
+
+// setParam replaces a request parameter wherever it was sent, in the URL
+// and/or in the form body.
+func (p *Proxy) setParam(r *http.Request, key, value string) error {
+	params := r.URL.Query()
+	if params.Has(key) {
+		params.Set(key, value)
+		r.URL.RawQuery = params.Encode()
+	}
+
+	if r.Method != http.MethodPost || r.Body == nil {
+		return nil
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/x-www-form-urlencoded" {
+		return nil
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return fmt.Errorf("error reading request body: %w", err)
+	}
+	r.Body.Close()
+
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return fmt.Errorf("error parsing request body: %w", err)
+	}
+
+	if form.Has(key) {
+		form.Set(key, value)
+		body = []byte(form.Encode())
+	}
+
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.Header.Set("Content-Length", fmt.Sprintf("%d", len(body)))
+
+	return nil
+}
+
+func (p *Proxy) parseRequest(r *http.Request) (interface{}, error) {
+	var metadataRequest domain.MetadataRequest
+
+	switch {
+	case r.URL.Path == "/api/v1/query" || r.URL.Path == "/api/v1/query_range":
+		params, err := p.parseParams(r)
+		if err != nil {
+			return nil, err
+		}
+
+		mode := domain.EnrichmentMode(params.Get("labelify_mode"))
+		if mode != "" && !mode.IsValid() {
+			return nil, fmt.Errorf("invalid labelify_mode %q", mode)
+		}
+
+		return domain.QueryRequest{
+			Query:   params.Get("query"),
+			Time:    params.Get("time"),
+			Start:   params.Get("start"),
+			End:     params.Get("end"),
+			Step:    params.Get("step"),
+			Timeout: params.Get("timeout"),
+			Range:   r.URL.Path == "/api/v1/query_range",
+			Mode:    mode,
+			Header:  r.Header,
+		}, nil
+	case r.URL.Path == "/api/v1/labels":
+		metadataRequest.Type = domain.MetadataTypeLabels
+	case r.URL.Path == "/api/v1/series":
+		metadataRequest.Type = domain.MetadataTypeSeries
+	case strings.HasPrefix(r.URL.Path, "/api/v1/label/") && strings.HasSuffix(r.URL.Path, "/values"):
+		metadataRequest.Type = domain.MetadataTypeLabelValues
+		metadataRequest.LabelName = strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/v1/label/"), "/values")
+	default:
+		return nil, nil
+	}
+
+	params, err := p.parseParams(r)
+	if err != nil {
+		return nil, err
+	}
+	metadataRequest.Matchers = params["match[]"]
+
+	return metadataRequest, nil
+}
+
+func (p *Proxy) readResponseBody(resp *http.Response) ([]byte, error) {
 	var body []byte
 	var err error
 
@@ -56,20 +202,38 @@ func (p *Proxy) modifyResponse(resp *http.Response) error {
 	}
 
 	if err != nil {
-		return fmt.Errorf("error reading response body: %w", err)
+		return nil, fmt.Errorf("error reading response body: %w", err)
 	}
 
 	resp.Body.Close()
 
+	return body, nil
+}
+
+func (p *Proxy) modifyResponse(resp *http.Response) error {
+	switch request := resp.Request.Context().Value(requestKey{}).(type) {
+	case domain.QueryRequest:
+		return p.modifyQueryResponse(resp, request)
+	case domain.MetadataRequest:
+		return p.modifyMetadataResponse(resp, request)
+	default:
+		return nil
+	}
+}
+
+func (p *Proxy) modifyQueryResponse(resp *http.Response, request domain.QueryRequest) error {
+	body, err := p.readResponseBody(resp)
+	if err != nil {
+		return err
+	}
+
 	var queryResponse domain.QueryResponse
-	if err := json.Unmarshal(body, &queryResponse); err != nil {
+	if err := json.Unmarshal(body, &queryResponse); err != nil || queryResponse.Status != "success" {
 		p.setResponseBody(resp, body)
 		return nil
 	}
 
-	query := resp.Request.URL.Query().Get("query")
-
-	if err := p.enrichment.Execute(&queryResponse, query); err != nil {
+	if err := p.enrichment.Execute(&queryResponse, request); err != nil {
 		p.setResponseBody(resp, body)
 		return nil
 	}
@@ -83,14 +247,161 @@ func (p *Proxy) modifyResponse(resp *http.Response) error {
 	return nil
 }
 
+func (p *Proxy) modifyMetadataResponse(resp *http.Response, request domain.MetadataRequest) error {
+	body, err := p.readResponseBody(resp)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		p.setResponseBody(resp, body)
+		return nil
+	}
+
+	var enriched interface{}
+
+	switch request.Type {
+	case domain.MetadataTypeLabels, domain.MetadataTypeLabelValues:
+		var labelsResponse domain.LabelsResponse
+		if err := json.Unmarshal(body, &labelsResponse); err != nil {
+			p.setResponseBody(resp, body)
+			return nil
+		}
+
+		if request.Type == domain.MetadataTypeLabels {
+			labelsResponse.Data = p.enrichment.EnrichLabelNames(labelsResponse.Data, request.Matchers)
+		} else {
+			labelsResponse.Data = p.enrichment.EnrichLabelValues(request.LabelName, labelsResponse.Data, request.Matchers)
+		}
+		enriched = labelsResponse
+	case domain.MetadataTypeSeries:
+		var seriesResponse domain.SeriesResponse
+		if err := json.Unmarshal(body, &seriesResponse); err != nil {
+			p.setResponseBody(resp, body)
+			return nil
+		}
+
+		seriesResponse.Data = p.enrichment.EnrichSeries(seriesResponse.Data, request.Matchers)
+		enriched = seriesResponse
+	}
+
+	newBody, err := json.Marshal(enriched)
+	if err != nil {
+		return fmt.Errorf("error marshaling enriched response: %w", err)
+	}
+
+	p.setResponseBody(resp, newBody)
+	return nil
+}
+
+// serveBinary answers binary operations between enriched operands, which
+// are evaluated by Labelify itself. It returns false when the request must
+// be proxied as usual.
+func (p *Proxy) serveBinary(w http.ResponseWriter, r *http.Request, request domain.QueryRequest) bool {
+	ctx := r.Context()
+	if request.Timeout != "" {
+		timeout, err := parseTimeout(request.Timeout)
+		if err != nil {
+			p.writeError(w, "bad_data", fmt.Sprintf("invalid timeout %q: %v", request.Timeout, err))
+			return true
+		}
+
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	resp, handled, err := p.enrichment.ExecuteBinary(ctx, request, p.client)
+	switch {
+	case err != nil && ctx.Err() != nil:
+		resp = &domain.QueryResponse{Status: "error", ErrorType: "timeout", Error: err.Error()}
+	case err != nil:
+		log.Printf("Error evaluating binary operation, proxying query as is: %v", err)
+		return false
+	case !handled:
+		return false
+	}
+
+	body, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error marshaling response: %v", err), http.StatusInternalServerError)
+		return true
+	}
+
+	statusCode := http.StatusOK
+	if resp.Status != "success" {
+		statusCode = http.StatusInternalServerError
+		if code, ok := errorStatusCodes[resp.ErrorType]; ok {
+			statusCode = code
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	_, _ = w.Write(body)
+
+	return true
+}
+
+// parseTimeout accepts a number of seconds or a duration such as "30s".
+func parseTimeout(value string) (time.Duration, error) {
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+	return time.ParseDuration(value)
+}
+
+// writeError answers with a Prometheus error response, which clients such
+// as Grafana know how to show.
+func (p *Proxy) writeError(w http.ResponseWriter, errorType, message string) {
+	statusCode, ok := errorStatusCodes[errorType]
+	if !ok {
+		statusCode = http.StatusInternalServerError
+	}
+
+	body, err := json.Marshal(map[string]string{
+		"status":    "error",
+		"errorType": errorType,
+		"error":     message,
+	})
+	if err != nil {
+		http.Error(w, message, statusCode)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	_, _ = w.Write(body)
+}
+
 func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// If the path is not /api/v1/query or /api/v1/query_range, serve the request as is
-	if r.URL.Path != "/api/v1/query" && r.URL.Path != "/api/v1/query_range" {
+	request, err := p.parseRequest(r)
+	if err != nil {
+		p.writeError(w, "bad_data", err.Error())
+		return
+	}
+
+	// If the path is not enrichable, serve the request as is
+	if request == nil {
 		p.proxy.ServeHTTP(w, r)
 		return
 	}
 
-	p.proxy.ModifyResponse = p.modifyResponse
+	// Filters on enriched labels are rewritten for Prometheus, but the
+	// response is still enriched according to the original query.
+	if queryRequest, ok := request.(domain.QueryRequest); ok {
+		if p.serveBinary(w, r, queryRequest) {
+			return
+		}
+
+		if query, rewritten := p.enrichment.RewriteQuery(queryRequest); rewritten {
+			if err := p.setParam(r, "query", query); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+	}
 
-	p.proxy.ServeHTTP(w, r)
+	ctx := context.WithValue(r.Context(), requestKey{}, request)
+	p.proxy.ServeHTTP(w, r.WithContext(ctx))
 }
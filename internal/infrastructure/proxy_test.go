@@ -0,0 +1,394 @@
+package infrastructure
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lucianocarvalho/labelify/internal/domain"
+	"github.com/lucianocarvalho/labelify/internal/usecase"
+)
+
+const vectorResponse = `{
+	"status": "success",
+	"data": {
+		"resultType": "vector",
+		"result": [
+			{"metric": {"deployment": "microservice-1"}, "value": [182778586, "2"]},
+			{"metric": {"deployment": "microservice-2"}, "value": [182778586, "3"]}
+		]
+	}
+}`
+
+func newTestProxy(t *testing.T, upstream *httptest.Server) *Proxy {
+	t.Helper()
+
+	config := &domain.Config{
+		Sources: []domain.Source{
+			{
+				Name: "just-a-random-source",
+				Type: "yaml",
+				Mappings: domain.Mappings{
+					{
+						Pattern: "microservice-.*",
+						SourceData: domain.SourceData{
+							Labels: map[string]string{
+								"team": "engineering",
+							},
+						},
+					},
+				},
+			},
+		},
+		Enrichment: domain.Enrichment{
+			Rules: []domain.EnrichmentRule{
+				{
+					Match:      domain.MatchRule{Metric: "kube_deployment_spec_replicas", Label: "deployment"},
+					EnrichFrom: "just-a-random-source",
+					AddLabels:  domain.AddLabels{{Name: "team"}},
+				},
+			},
+		},
+	}
+
+	uc, err := usecase.NewEnrichmentUseCase(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy, err := NewProxy(upstream.URL, uc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return proxy
+}
+
+func TestProxy_ServeHTTP(t *testing.T) {
+	t.Run("given a form-encoded POST to /api/v1/query", func(t *testing.T) {
+		var receivedBody string
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			receivedBody = string(body)
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(vectorResponse))
+		}))
+		defer upstream.Close()
+
+		proxy := newTestProxy(t, upstream)
+
+		form := url.Values{}
+		form.Set("query", "sum(kube_deployment_spec_replicas) by (deployment)")
+		form.Set("time", "182778586")
+
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/query", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+
+		proxy.ServeHTTP(rec, req)
+
+		t.Run("then it should forward the body unchanged", func(t *testing.T) {
+			if receivedBody != form.Encode() {
+				t.Fatalf("expected body %q, got %q", form.Encode(), receivedBody)
+			}
+		})
+
+		t.Run("then it should enrich the response using the query from the body", func(t *testing.T) {
+			var response domain.QueryResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+
+			expected := []domain.MetricData{
+				{
+					Metric: map[string]string{
+						"team": "engineering",
+					},
+					Value: []interface{}{
+						float64(182778586),
+						"5",
+					},
+				},
+			}
+
+			if !reflect.DeepEqual(response.Data.Result, expected) {
+				t.Fatalf("expected %+v, got %+v", expected, response.Data.Result)
+			}
+		})
+	})
+
+	t.Run("given an invalid labelify_mode", func(t *testing.T) {
+		called := false
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			called = true
+		}))
+		defer upstream.Close()
+
+		proxy := newTestProxy(t, upstream)
+
+		params := url.Values{}
+		params.Set("query", "kube_deployment_spec_replicas")
+		params.Set("labelify_mode", "collapse")
+
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/query?"+params.Encode(), http.NoBody)
+		rec := httptest.NewRecorder()
+
+		proxy.ServeHTTP(rec, req)
+
+		t.Run("then it should answer with a Prometheus bad_data error", func(t *testing.T) {
+			if rec.Code != http.StatusBadRequest {
+				t.Fatalf("expected status code %d, got %d", http.StatusBadRequest, rec.Code)
+			}
+			if contentType := rec.Header().Get("Content-Type"); contentType != "application/json" {
+				t.Fatalf("expected a JSON response, got %s", contentType)
+			}
+
+			var response map[string]string
+			if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+
+			expected := map[string]string{
+				"status":    "error",
+				"errorType": "bad_data",
+				"error":     `invalid labelify_mode "collapse"`,
+			}
+			if !reflect.DeepEqual(response, expected) {
+				t.Fatalf("expected %+v, got %+v", expected, response)
+			}
+		})
+
+		t.Run("then it should not query Prometheus", func(t *testing.T) {
+			if called {
+				t.Fatal("expected Prometheus not to be queried")
+			}
+		})
+	})
+
+	t.Run("given a query filtering on an enriched label", func(t *testing.T) {
+		var receivedQuery string
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			receivedQuery = r.URL.Query().Get("query")
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(vectorResponse))
+		}))
+		defer upstream.Close()
+
+		proxy := newTestProxy(t, upstream)
+
+		params := url.Values{}
+		params.Set("query", `sum(kube_deployment_spec_replicas{team="engineering"}) by (team)`)
+
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/query?"+params.Encode(), http.NoBody)
+		rec := httptest.NewRecorder()
+
+		proxy.ServeHTTP(rec, req)
+
+		t.Run("then it should forward the filter and the grouping on the source label", func(t *testing.T) {
+			expected := `sum by (deployment) (kube_deployment_spec_replicas{deployment!="",deployment=~".*(?:microservice-.*).*"})`
+			if receivedQuery != expected {
+				t.Fatalf("expected query %q, got %q", expected, receivedQuery)
+			}
+		})
+
+		t.Run("then it should enrich the response using the original query", func(t *testing.T) {
+			var response domain.QueryResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+
+			expected := []domain.MetricData{
+				{
+					Metric: map[string]string{
+						"team": "engineering",
+					},
+					Value: []interface{}{
+						float64(182778586),
+						"5",
+					},
+				},
+			}
+
+			if !reflect.DeepEqual(response.Data.Result, expected) {
+				t.Fatalf("expected %+v, got %+v", expected, response.Data.Result)
+			}
+		})
+	})
+
+	t.Run("given a query grouped by an enriched label in keep mode", func(t *testing.T) {
+		var receivedQuery string
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			receivedQuery = r.URL.Query().Get("query")
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(vectorResponse))
+		}))
+		defer upstream.Close()
+
+		proxy := newTestProxy(t, upstream)
+
+		params := url.Values{}
+		params.Set("query", `sum(kube_deployment_spec_replicas) by (team)`)
+		params.Set("labelify_mode", "keep")
+
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/query?"+params.Encode(), http.NoBody)
+		rec := httptest.NewRecorder()
+
+		proxy.ServeHTTP(rec, req)
+
+		t.Run("then it should not push the grouping down, since the series aren't regrouped", func(t *testing.T) {
+			expected := `sum(kube_deployment_spec_replicas) by (team)`
+			if receivedQuery != expected {
+				t.Fatalf("expected query %q, got %q", expected, receivedQuery)
+			}
+		})
+	})
+
+	t.Run("given a binary operation between enriched operands", func(t *testing.T) {
+		var receivedQueries, receivedPaths []string
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_ = r.ParseForm()
+			receivedQueries = append(receivedQueries, r.Form.Get("query"))
+			receivedPaths = append(receivedPaths, r.URL.Path)
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(vectorResponse))
+		}))
+		defer upstream.Close()
+
+		proxy := newTestProxy(t, upstream)
+
+		params := url.Values{}
+		params.Set("query", `sum(kube_deployment_spec_replicas) by (deployment) / sum(kube_deployment_spec_replicas) by (deployment)`)
+		params.Set("time", "182778586")
+		params.Set("step", "60")
+		params.Set("timeout", "30s")
+
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/query?"+params.Encode(), http.NoBody)
+		rec := httptest.NewRecorder()
+
+		proxy.ServeHTTP(rec, req)
+
+		t.Run("then it should query each side separately", func(t *testing.T) {
+			expected := []string{
+				`sum by (deployment) (kube_deployment_spec_replicas)`,
+				`sum by (deployment) (kube_deployment_spec_replicas)`,
+			}
+			if !reflect.DeepEqual(receivedQueries, expected) {
+				t.Fatalf("expected queries %q, got %q", expected, receivedQueries)
+			}
+		})
+
+		t.Run("then it should run them as instant queries despite the step", func(t *testing.T) {
+			expected := []string{"/api/v1/query", "/api/v1/query"}
+			if !reflect.DeepEqual(receivedPaths, expected) {
+				t.Fatalf("expected paths %q, got %q", expected, receivedPaths)
+			}
+		})
+
+		t.Run("then it should divide the regrouped series", func(t *testing.T) {
+			var response domain.QueryResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+
+			expected := []domain.MetricData{
+				{
+					Metric: map[string]string{
+						"team": "engineering",
+					},
+					Value: []interface{}{
+						float64(182778586),
+						"1",
+					},
+				},
+			}
+
+			if !reflect.DeepEqual(response.Data.Result, expected) {
+				t.Fatalf("expected %+v, got %+v", expected, response.Data.Result)
+			}
+		})
+	})
+
+	t.Run("given a binary operation exceeding its timeout", func(t *testing.T) {
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_ = r.ParseForm()
+			select {
+			case <-r.Context().Done():
+			case <-time.After(time.Second):
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(vectorResponse))
+		}))
+		defer upstream.Close()
+
+		proxy := newTestProxy(t, upstream)
+
+		params := url.Values{}
+		params.Set("query", `sum(kube_deployment_spec_replicas) by (deployment) / sum(kube_deployment_spec_replicas) by (deployment)`)
+		params.Set("timeout", "0.05")
+
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/query?"+params.Encode(), http.NoBody)
+		rec := httptest.NewRecorder()
+
+		proxy.ServeHTTP(rec, req)
+
+		t.Run("then it should return a timeout error", func(t *testing.T) {
+			var response domain.QueryResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+
+			if rec.Code != http.StatusServiceUnavailable || response.ErrorType != "timeout" {
+				t.Fatalf("expected a timeout error, got %d %+v", rec.Code, response)
+			}
+		})
+	})
+
+	t.Run("given a GET to /api/v1/label/team/values", func(t *testing.T) {
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"status":"success","data":[]}`))
+		}))
+		defer upstream.Close()
+
+		proxy := newTestProxy(t, upstream)
+
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/label/team/values?match[]=kube_deployment_spec_replicas", http.NoBody)
+		rec := httptest.NewRecorder()
+
+		proxy.ServeHTTP(rec, req)
+
+		t.Run("then it should return the values from the source", func(t *testing.T) {
+			expected := `{"status":"success","data":["engineering"]}`
+			if rec.Body.String() != expected {
+				t.Fatalf("expected %q, got %q", expected, rec.Body.String())
+			}
+		})
+	})
+
+	t.Run("given a GET to a path that is not a query", func(t *testing.T) {
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(vectorResponse))
+		}))
+		defer upstream.Close()
+
+		proxy := newTestProxy(t, upstream)
+
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/status/config?query=kube_deployment_spec_replicas", http.NoBody)
+		rec := httptest.NewRecorder()
+
+		proxy.ServeHTTP(rec, req)
+
+		t.Run("then it should return the upstream response untouched", func(t *testing.T) {
+			if rec.Body.String() != vectorResponse {
+				t.Fatalf("expected %q, got %q", vectorResponse, rec.Body.String())
+			}
+		})
+	})
+}
@@ -15,7 +15,8 @@ type HTTPSource struct {
 	name     string
 	config   domain.SourceConfig
 	client   *http.Client
-	mappings map[string]domain.SourceData
+	mappings domain.Mappings
+	revision uint64
 	mu       sync.RWMutex
 }
 
@@ -45,12 +46,18 @@ func NewHTTPSource(name string, config domain.SourceConfig) *HTTPSource {
 	return source
 }
 
-func (s *HTTPSource) GetMappings() (map[string]domain.SourceData, error) {
+func (s *HTTPSource) GetMappings() (domain.Mappings, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	return s.mappings, nil
 }
 
+func (s *HTTPSource) Revision() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.revision
+}
+
 func (s *HTTPSource) Name() string {
 	return s.name
 }
@@ -80,13 +87,14 @@ func (s *HTTPSource) refresh() error {
 		return fmt.Errorf("error reading response body: %w", err)
 	}
 
-	var newMappings map[string]domain.SourceData
+	var newMappings domain.Mappings
 	if err := json.Unmarshal(body, &newMappings); err != nil {
 		return fmt.Errorf("error unmarshaling response: %w", err)
 	}
 
 	s.mu.Lock()
 	s.mappings = newMappings
+	s.revision++
 	s.mu.Unlock()
 
 	return nil
@@ -4,20 +4,25 @@ import "github.com/lucianocarvalho/labelify/internal/domain"
 
 type YAMLSource struct {
 	name     string
-	mappings map[string]domain.SourceData
+	mappings domain.Mappings
 }
 
-func NewYAMLSource(name string, mappings map[string]domain.SourceData) *YAMLSource {
+func NewYAMLSource(name string, mappings domain.Mappings) *YAMLSource {
 	return &YAMLSource{
 		name:     name,
 		mappings: mappings,
 	}
 }
 
-func (s *YAMLSource) GetMappings() (map[string]domain.SourceData, error) {
+func (s *YAMLSource) GetMappings() (domain.Mappings, error) {
 	return s.mappings, nil
 }
 
+// Static mappings never change.
+func (s *YAMLSource) Revision() uint64 {
+	return 0
+}
+
 func (s *YAMLSource) Name() string {
 	return s.name
 }
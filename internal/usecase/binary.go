@@ -0,0 +1,592 @@
+package usecase
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/lucianocarvalho/labelify/internal/domain"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// upstreamError carries the error response of an operand, sent back as is.
+type upstreamError struct {
+	resp *domain.QueryResponse
+}
+
+func (e *upstreamError) Error() string {
+	return e.resp.Error
+}
+
+type executionError struct {
+	msg string
+}
+
+func (e *executionError) Error() string {
+	return e.msg
+}
+
+type vectorSample struct {
+	metric map[string]string
+	value  float64
+}
+
+// operand is one side of a binary operation, as instant vectors indexed by
+// timestamp.
+type operand struct {
+	scalar   bool
+	constant *float64
+	vectors  map[float64][]vectorSample
+}
+
+func (o *operand) scalarAt(timestamp float64) (float64, bool) {
+	if o.constant != nil {
+		return *o.constant, true
+	}
+
+	samples := o.vectors[timestamp]
+	if len(samples) == 0 {
+		return 0, false
+	}
+	return samples[0].value, true
+}
+
+// ExecuteBinary evaluates binary operations between enriched operands once
+// each side is regrouped, so ratios aren't added together. It returns false
+// when the query must be proxied as usual.
+func (h *EnrichmentUseCase) ExecuteBinary(ctx context.Context, request domain.QueryRequest, client domain.QueryClient) (*domain.QueryResponse, bool, error) {
+	expr, err := parser.ParseExpr(request.Query)
+	if err != nil {
+		return nil, false, nil
+	}
+
+	binary, ok := unwrapParens(expr).(*parser.BinaryExpr)
+	if !ok || !h.splittable(binary) || h.getMode(request, h.binaryMatches(binary)) == domain.EnrichmentModeKeep {
+		return nil, false, nil
+	}
+
+	log.Printf("Evaluating binary operation of query '%s' locally", request.Query)
+
+	resp := &domain.QueryResponse{
+		Status: "success",
+		Data: domain.QueryData{
+			ResultType: "vector",
+		},
+	}
+
+	if request.Range {
+		resp.Data.ResultType = "matrix"
+	} else if request.Time == "" {
+		// Both sides must be evaluated at the very same time to match.
+		request.Time = strconv.FormatFloat(float64(time.Now().UnixMilli())/1000, 'f', 3, 64)
+	}
+
+	result, err := h.evaluateBinary(ctx, binary, request, client, resp)
+
+	var upstream *upstreamError
+	var execution *executionError
+
+	switch {
+	case errors.As(err, &upstream):
+		return upstream.resp, true, nil
+	case errors.As(err, &execution):
+		resp.Status = "error"
+		resp.ErrorType = "execution"
+		resp.Error = execution.Error()
+		resp.Data = domain.QueryData{}
+		return resp, true, nil
+	case err != nil:
+		return nil, false, err
+	}
+
+	resp.Data.Result = h.operandMetrics(result, !request.Range)
+	return resp, true, nil
+}
+
+// splittable tells whether both sides of a binary operation can be
+// evaluated and regrouped on their own. Operations on series that aren't
+// regrouped (eg: info joins or filters) are left to Prometheus.
+func (h *EnrichmentUseCase) splittable(e *parser.BinaryExpr) bool {
+	return e.Type() == parser.ValueTypeVector && h.splittableOperand(e.LHS) && h.splittableOperand(e.RHS)
+}
+
+// splittableOperand tells whether an operand is a scalar, or an aggregation
+// of enriched series whose groups can be merged again.
+func (h *EnrichmentUseCase) splittableOperand(expr parser.Expr) bool {
+	expr = unwrapParens(expr)
+	if expr.Type() == parser.ValueTypeScalar {
+		return true
+	}
+
+	if binary, ok := expr.(*parser.BinaryExpr); ok {
+		return h.splittable(binary)
+	}
+
+	aggregate := outermostAggregation(expr)
+	if aggregate == nil {
+		return false
+	}
+	if _, err := mergeAggregation(aggregate.Op); err != nil {
+		return false
+	}
+	return len(h.matchRules(expr)) > 0
+}
+
+func (h *EnrichmentUseCase) binaryMatches(e *parser.BinaryExpr) []*ruleMatch {
+	return append(h.matchRules(e.LHS), h.matchRules(e.RHS)...)
+}
+
+func (h *EnrichmentUseCase) evaluateBinary(ctx context.Context, e *parser.BinaryExpr, request domain.QueryRequest, client domain.QueryClient, resp *domain.QueryResponse) (*operand, error) {
+	lhs, err := h.evaluateOperand(ctx, e.LHS, request, client, resp)
+	if err != nil {
+		return nil, err
+	}
+
+	rhs, err := h.evaluateOperand(ctx, e.RHS, request, client, resp)
+	if err != nil {
+		return nil, err
+	}
+
+	matching := h.translateMatching(e)
+
+	result := &operand{vectors: make(map[float64][]vectorSample)}
+	for _, timestamp := range operandTimestamps(lhs, rhs) {
+		var samples []vectorSample
+
+		switch {
+		case lhs.scalar:
+			value, ok := lhs.scalarAt(timestamp)
+			if !ok {
+				continue
+			}
+			samples = vectorScalarBinop(e.Op, rhs.vectors[timestamp], value, true, e.ReturnBool)
+		case rhs.scalar:
+			value, ok := rhs.scalarAt(timestamp)
+			if !ok {
+				continue
+			}
+			samples = vectorScalarBinop(e.Op, lhs.vectors[timestamp], value, false, e.ReturnBool)
+		default:
+			samples, err = h.vectorBinop(e.Op, lhs.vectors[timestamp], rhs.vectors[timestamp], matching, e.ReturnBool)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if len(samples) > 0 {
+			result.vectors[timestamp] = samples
+		}
+	}
+
+	return result, nil
+}
+
+func (h *EnrichmentUseCase) evaluateOperand(ctx context.Context, expr parser.Expr, request domain.QueryRequest, client domain.QueryClient, resp *domain.QueryResponse) (*operand, error) {
+	expr = unwrapParens(expr)
+
+	if literal, ok := expr.(*parser.NumberLiteral); ok {
+		return &operand{scalar: true, constant: &literal.Val}, nil
+	}
+
+	if binary, ok := expr.(*parser.BinaryExpr); ok && h.splittable(binary) {
+		return h.evaluateBinary(ctx, binary, request, client, resp)
+	}
+
+	scalar := expr.Type() == parser.ValueTypeScalar
+
+	side := request
+	side.Query = expr.String()
+	if scalar {
+		side.Query = fmt.Sprintf("vector(%s)", side.Query)
+	}
+
+	upstream := side
+	if query, rewritten := h.RewriteQuery(side); rewritten {
+		upstream.Query = query
+	}
+
+	sideResp, err := client.Query(ctx, upstream)
+	if err != nil {
+		return nil, fmt.Errorf("error querying '%s': %w", upstream.Query, err)
+	}
+
+	if sideResp.Status != "success" {
+		return nil, &upstreamError{resp: sideResp}
+	}
+
+	if err := h.Execute(sideResp, side); err != nil {
+		return nil, err
+	}
+
+	for _, warning := range sideResp.Warnings {
+		h.addWarning(resp, warning)
+	}
+	for _, info := range sideResp.Infos {
+		if !slices.Contains(resp.Infos, info) {
+			resp.Infos = append(resp.Infos, info)
+		}
+	}
+
+	result := &operand{scalar: scalar, vectors: make(map[float64][]vectorSample)}
+	for _, r := range sideResp.Data.Result {
+		if len(r.Histogram) > 0 || len(r.Histograms) > 0 {
+			h.addWarning(resp, "native histograms are not supported in binary operations evaluated by Labelify, samples were dropped")
+		}
+
+		samples := r.Values
+		if len(r.Value) == 2 {
+			samples = append(samples, r.Value)
+		}
+
+		for _, sample := range samples {
+			value, err := parseSampleValue(sample[1])
+			if err != nil {
+				h.addWarning(resp, fmt.Sprintf("invalid sample value: %v", err))
+				continue
+			}
+
+			timestamp := sample[0].(float64)
+			result.vectors[timestamp] = append(result.vectors[timestamp], vectorSample{metric: r.Metric, value: value})
+		}
+	}
+
+	return result, nil
+}
+
+// translateMatching replaces the rules source labels in on() and group_x()
+// with the enriched ones.
+func (h *EnrichmentUseCase) translateMatching(e *parser.BinaryExpr) *parser.VectorMatching {
+	if e.VectorMatching == nil {
+		return nil
+	}
+
+	enriched := make(map[string][]string)
+	for _, match := range h.binaryMatches(e) {
+		for _, label := range match.rule.candidateLabels() {
+			enriched[label] = append(enriched[label], match.rule.enrichedLabels()...)
+		}
+	}
+
+	matching := *e.VectorMatching
+	if matching.On {
+		matching.MatchingLabels = translateLabels(matching.MatchingLabels, enriched)
+	}
+	matching.Include = translateLabels(matching.Include, enriched)
+
+	return &matching
+}
+
+func translateLabels(names []string, enriched map[string][]string) []string {
+	var translated []string
+	for _, name := range names {
+		replacements, ok := enriched[name]
+		if !ok {
+			replacements = []string{name}
+		}
+
+		for _, replacement := range replacements {
+			if !slices.Contains(translated, replacement) {
+				translated = append(translated, replacement)
+			}
+		}
+	}
+	return translated
+}
+
+func operandTimestamps(operands ...*operand) []float64 {
+	set := make(map[float64]bool)
+	for _, o := range operands {
+		for timestamp := range o.vectors {
+			set[timestamp] = true
+		}
+	}
+
+	timestamps := make([]float64, 0, len(set))
+	for timestamp := range set {
+		timestamps = append(timestamps, timestamp)
+	}
+	sort.Float64s(timestamps)
+
+	return timestamps
+}
+
+func (h *EnrichmentUseCase) operandMetrics(o *operand, instant bool) []domain.MetricData {
+	result := make([]domain.MetricData, 0)
+	index := make(map[string]int)
+
+	for _, timestamp := range operandTimestamps(o) {
+		for _, sample := range o.vectors[timestamp] {
+			key := h.createGroupKey(sample.metric)
+
+			i, ok := index[key]
+			if !ok {
+				i = len(result)
+				index[key] = i
+				result = append(result, domain.MetricData{Metric: sample.metric})
+			}
+
+			point := []interface{}{timestamp, formatSampleValue(sample.value)}
+			if instant {
+				result[i].Value = point
+			} else {
+				result[i].Values = append(result[i].Values, point)
+			}
+		}
+	}
+
+	return result
+}
+
+func vectorScalarBinop(op parser.ItemType, samples []vectorSample, scalar float64, swap, returnBool bool) []vectorSample {
+	var result []vectorSample
+
+	for _, sample := range samples {
+		lhs, rhs := sample.value, scalar
+		if swap {
+			lhs, rhs = rhs, lhs
+		}
+
+		value, keep := binaryFloat(op, lhs, rhs)
+		// Comparisons keep the vector value, even on the right hand side.
+		if op.IsComparisonOperator() && swap {
+			value = rhs
+		}
+		if returnBool {
+			value, keep = boolValue(keep), true
+		}
+		if !keep {
+			continue
+		}
+
+		metric := sample.metric
+		if shouldDropMetricName(op) || returnBool {
+			metric = withoutMetricName(metric)
+		}
+
+		result = append(result, vectorSample{metric: metric, value: value})
+	}
+
+	return result
+}
+
+func (h *EnrichmentUseCase) vectorBinop(op parser.ItemType, lhs, rhs []vectorSample, matching *parser.VectorMatching, returnBool bool) ([]vectorSample, error) {
+	if op.IsSetOperator() {
+		return h.setBinop(op, lhs, rhs, matching), nil
+	}
+
+	if matching.Card == parser.CardOneToMany {
+		lhs, rhs = rhs, lhs
+	}
+
+	rightSigs := make(map[string]vectorSample)
+	for _, sample := range rhs {
+		sig := h.signature(sample.metric, matching)
+		if _, duplicate := rightSigs[sig]; duplicate {
+			side := "right"
+			if matching.Card == parser.CardOneToMany {
+				side = "left"
+			}
+			return nil, &executionError{msg: fmt.Sprintf("found duplicate series for the match group {%s} on the %s hand-side of the operation; many-to-many matching not allowed: matching labels must be unique on one side", sig, side)}
+		}
+		rightSigs[sig] = sample
+	}
+
+	matchedSigs := make(map[string]map[string]bool)
+	var result []vectorSample
+
+	for _, ls := range lhs {
+		sig := h.signature(ls.metric, matching)
+		rs, ok := rightSigs[sig]
+		if !ok {
+			continue
+		}
+
+		left, right := ls.value, rs.value
+		if matching.Card == parser.CardOneToMany {
+			left, right = right, left
+		}
+
+		value, keep := binaryFloat(op, left, right)
+		if returnBool {
+			value, keep = boolValue(keep), true
+		}
+		if !keep {
+			continue
+		}
+
+		metric := resultMetric(ls.metric, rs.metric, op, matching)
+		if returnBool {
+			metric = withoutMetricName(metric)
+		}
+
+		inserted, exists := matchedSigs[sig]
+		if matching.Card == parser.CardOneToOne {
+			if exists {
+				return nil, &executionError{msg: "multiple matches for labels: many-to-one matching must be explicit (group_left/group_right)"}
+			}
+			matchedSigs[sig] = nil
+		} else {
+			key := h.createGroupKey(metric)
+			if !exists {
+				inserted = make(map[string]bool)
+				matchedSigs[sig] = inserted
+			} else if inserted[key] {
+				return nil, &executionError{msg: "multiple matches for labels: grouping labels must ensure unique matches"}
+			}
+			inserted[key] = true
+		}
+
+		result = append(result, vectorSample{metric: metric, value: value})
+	}
+
+	return result, nil
+}
+
+func (h *EnrichmentUseCase) setBinop(op parser.ItemType, lhs, rhs []vectorSample, matching *parser.VectorMatching) []vectorSample {
+	signatures := func(samples []vectorSample) map[string]bool {
+		sigs := make(map[string]bool)
+		for _, sample := range samples {
+			sigs[h.signature(sample.metric, matching)] = true
+		}
+		return sigs
+	}
+
+	var result []vectorSample
+
+	switch op {
+	case parser.LAND:
+		rightSigs := signatures(rhs)
+		for _, sample := range lhs {
+			if rightSigs[h.signature(sample.metric, matching)] {
+				result = append(result, sample)
+			}
+		}
+	case parser.LOR:
+		leftSigs := signatures(lhs)
+		result = append(result, lhs...)
+		for _, sample := range rhs {
+			if !leftSigs[h.signature(sample.metric, matching)] {
+				result = append(result, sample)
+			}
+		}
+	case parser.LUNLESS:
+		rightSigs := signatures(rhs)
+		for _, sample := range lhs {
+			if !rightSigs[h.signature(sample.metric, matching)] {
+				result = append(result, sample)
+			}
+		}
+	}
+
+	return result
+}
+
+func (h *EnrichmentUseCase) signature(metric map[string]string, matching *parser.VectorMatching) string {
+	sig := make(map[string]string)
+	for name, value := range metric {
+		listed := slices.Contains(matching.MatchingLabels, name)
+		if matching.On && listed || !matching.On && !listed && name != labels.MetricName {
+			sig[name] = value
+		}
+	}
+	return h.createGroupKey(sig)
+}
+
+func resultMetric(lhs, rhs map[string]string, op parser.ItemType, matching *parser.VectorMatching) map[string]string {
+	metric := make(map[string]string, len(lhs))
+	for name, value := range lhs {
+		metric[name] = value
+	}
+
+	if shouldDropMetricName(op) {
+		delete(metric, labels.MetricName)
+	}
+
+	if matching.Card == parser.CardOneToOne {
+		for name := range metric {
+			if matching.On != slices.Contains(matching.MatchingLabels, name) {
+				delete(metric, name)
+			}
+		}
+	}
+
+	for _, name := range matching.Include {
+		if value := rhs[name]; value != "" {
+			metric[name] = value
+		} else {
+			delete(metric, name)
+		}
+	}
+
+	return metric
+}
+
+func binaryFloat(op parser.ItemType, lhs, rhs float64) (float64, bool) {
+	switch op {
+	case parser.ADD:
+		return lhs + rhs, true
+	case parser.SUB:
+		return lhs - rhs, true
+	case parser.MUL:
+		return lhs * rhs, true
+	case parser.DIV:
+		return lhs / rhs, true
+	case parser.POW:
+		return math.Pow(lhs, rhs), true
+	case parser.MOD:
+		return math.Mod(lhs, rhs), true
+	case parser.ATAN2:
+		return math.Atan2(lhs, rhs), true
+	case parser.EQLC:
+		return lhs, lhs == rhs
+	case parser.NEQ:
+		return lhs, lhs != rhs
+	case parser.GTR:
+		return lhs, lhs > rhs
+	case parser.LSS:
+		return lhs, lhs < rhs
+	case parser.GTE:
+		return lhs, lhs >= rhs
+	case parser.LTE:
+		return lhs, lhs <= rhs
+	default:
+		return 0, false
+	}
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func shouldDropMetricName(op parser.ItemType) bool {
+	switch op {
+	case parser.ADD, parser.SUB, parser.MUL, parser.DIV, parser.POW, parser.MOD, parser.ATAN2:
+		return true
+	default:
+		return false
+	}
+}
+
+func withoutMetricName(metric map[string]string) map[string]string {
+	if _, ok := metric[labels.MetricName]; !ok {
+		return metric
+	}
+
+	result := make(map[string]string, len(metric))
+	for name, value := range metric {
+		if name != labels.MetricName {
+			result[name] = value
+		}
+	}
+	return result
+}
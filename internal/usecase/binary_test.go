@@ -0,0 +1,248 @@
+package usecase
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/lucianocarvalho/labelify/internal/domain"
+)
+
+type fakeQueryClient struct {
+	responses map[string]string
+	queries   []string
+}
+
+func (c *fakeQueryClient) Query(_ context.Context, request domain.QueryRequest) (*domain.QueryResponse, error) {
+	c.queries = append(c.queries, request.Query)
+
+	body, ok := c.responses[request.Query]
+	if !ok {
+		body = `{"status":"success","data":{"resultType":"vector","result":[]}}`
+	}
+
+	var resp domain.QueryResponse
+	if err := json.Unmarshal([]byte(body), &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func TestEnrichmentUseCase_ExecuteBinary(t *testing.T) {
+	config := &domain.Config{
+		Sources: []domain.Source{
+			{
+				Name: "just-a-random-source",
+				Type: "yaml",
+				Mappings: domain.Mappings{
+					{
+						Pattern: "microservice-.*",
+						SourceData: domain.SourceData{
+							Labels: map[string]string{
+								"team": "engineering",
+							},
+						},
+					},
+					{
+						Pattern: "billing-.*",
+						SourceData: domain.SourceData{
+							Labels: map[string]string{
+								"team": "finance",
+							},
+						},
+					},
+				},
+			},
+		},
+		Enrichment: domain.Enrichment{
+			Rules: []domain.EnrichmentRule{
+				{
+					Match:      domain.MatchRule{Metric: `{__name__=~"http_.*_total"}`, Label: "deployment"},
+					EnrichFrom: "just-a-random-source",
+					AddLabels:  domain.AddLabels{{Name: "team"}},
+				},
+			},
+		},
+	}
+
+	uc, err := NewEnrichmentUseCase(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &fakeQueryClient{
+		responses: map[string]string{
+			`sum by (deployment) (rate(http_errors_total[5m]))`: `{
+				"status": "success",
+				"data": {
+					"resultType": "vector",
+					"result": [
+						{"metric": {"deployment": "microservice-1"}, "value": [182778586, "1"]},
+						{"metric": {"deployment": "microservice-2"}, "value": [182778586, "3"]},
+						{"metric": {"deployment": "billing-1"}, "value": [182778586, "5"]}
+					]
+				}
+			}`,
+			`sum by (deployment) (rate(http_requests_total[5m]))`: `{
+				"status": "success",
+				"data": {
+					"resultType": "vector",
+					"result": [
+						{"metric": {"deployment": "microservice-1"}, "value": [182778586, "10"]},
+						{"metric": {"deployment": "microservice-2"}, "value": [182778586, "10"]},
+						{"metric": {"deployment": "billing-1"}, "value": [182778586, "50"]}
+					]
+				}
+			}`,
+			`vector(scalar(up))`: `{
+				"status": "success",
+				"data": {
+					"resultType": "vector",
+					"result": [
+						{"metric": {}, "value": [182778586, "2"]}
+					]
+				}
+			}`,
+			`sum by (deployment) (http_failing_total)`: `{
+				"status": "error",
+				"errorType": "bad_data",
+				"error": "something went wrong"
+			}`,
+		},
+	}
+
+	testCases := []struct {
+		name     string
+		query    string
+		expected *domain.QueryResponse
+	}{
+		{
+			name:  "a ratio between enriched operands",
+			query: `sum(rate(http_errors_total[5m])) by (deployment) / sum(rate(http_requests_total[5m])) by (deployment)`,
+			expected: &domain.QueryResponse{
+				Status: "success",
+				Data: domain.QueryData{
+					ResultType: "vector",
+					Result: []domain.MetricData{
+						{Metric: map[string]string{"team": "engineering"}, Value: []interface{}{float64(182778586), "0.2"}},
+						{Metric: map[string]string{"team": "finance"}, Value: []interface{}{float64(182778586), "0.1"}},
+					},
+				},
+			},
+		},
+		{
+			name:  "a ratio matched on the source label",
+			query: `(sum(rate(http_errors_total[5m])) by (deployment) / on (deployment) sum(rate(http_requests_total[5m])) by (deployment)) * 100`,
+			expected: &domain.QueryResponse{
+				Status: "success",
+				Data: domain.QueryData{
+					ResultType: "vector",
+					Result: []domain.MetricData{
+						{Metric: map[string]string{"team": "engineering"}, Value: []interface{}{float64(182778586), "20"}},
+						{Metric: map[string]string{"team": "finance"}, Value: []interface{}{float64(182778586), "10"}},
+					},
+				},
+			},
+		},
+		{
+			name:  "a comparison with a scalar queried upstream",
+			query: `sum(rate(http_errors_total[5m])) by (deployment) > scalar(up)`,
+			expected: &domain.QueryResponse{
+				Status: "success",
+				Data: domain.QueryData{
+					ResultType: "vector",
+					Result: []domain.MetricData{
+						{Metric: map[string]string{"team": "engineering"}, Value: []interface{}{float64(182778586), "4"}},
+						{Metric: map[string]string{"team": "finance"}, Value: []interface{}{float64(182778586), "5"}},
+					},
+				},
+			},
+		},
+		{
+			name:  "a set operation between enriched operands",
+			query: `sum(rate(http_errors_total[5m])) by (deployment) unless sum(http_unknown_total) by (deployment)`,
+			expected: &domain.QueryResponse{
+				Status: "success",
+				Data: domain.QueryData{
+					ResultType: "vector",
+					Result: []domain.MetricData{
+						{Metric: map[string]string{"team": "engineering"}, Value: []interface{}{float64(182778586), "4"}},
+						{Metric: map[string]string{"team": "finance"}, Value: []interface{}{float64(182778586), "5"}},
+					},
+				},
+			},
+		},
+		{
+			name:  "an operand failing upstream",
+			query: `sum(http_failing_total) by (deployment) / sum(rate(http_requests_total[5m])) by (deployment)`,
+			expected: &domain.QueryResponse{
+				Status:    "error",
+				ErrorType: "bad_data",
+				Error:     "something went wrong",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run("given "+tc.name, func(t *testing.T) {
+			resp, handled, err := uc.ExecuteBinary(context.Background(), domain.QueryRequest{Query: tc.query, Time: "182778586"}, client)
+
+			t.Run("then it should evaluate the operation between the regrouped series", func(t *testing.T) {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !handled {
+					t.Fatal("expected the query to be handled")
+				}
+				if !reflect.DeepEqual(resp, tc.expected) {
+					t.Fatalf("expected %+v, got %+v", tc.expected, resp)
+				}
+			})
+		})
+	}
+
+	t.Run("given a many-to-many match after regrouping", func(t *testing.T) {
+		resp, _, err := uc.ExecuteBinary(context.Background(), domain.QueryRequest{
+			Query: `sum(rate(http_errors_total[5m])) by (deployment) / on () sum(rate(http_requests_total[5m])) by (deployment)`,
+			Time:  "182778586",
+		}, client)
+
+		t.Run("then it should return an execution error", func(t *testing.T) {
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.Status != "error" || resp.ErrorType != "execution" {
+				t.Fatalf("expected an execution error, got %+v", resp)
+			}
+		})
+	})
+
+	for _, tc := range []struct {
+		name  string
+		query string
+	}{
+		{name: "a binary operation without enriched operands", query: `sum(up) / sum(up)`},
+		{name: "an info join", query: `rate(http_requests_total[5m]) * on (node) group_left (zone) kube_node_info`},
+		{name: "a set operation joined on another label", query: `http_requests_total and on (node) kube_node_info`},
+		{name: "a comparison filter", query: `rate(http_requests_total[5m]) > 1`},
+		{name: "an operand whose groups can't be merged", query: `avg(rate(http_errors_total[5m])) by (deployment) / sum(rate(http_requests_total[5m])) by (deployment)`},
+	} {
+		t.Run("given "+tc.name, func(t *testing.T) {
+			queries := len(client.queries)
+			_, handled, err := uc.ExecuteBinary(context.Background(), domain.QueryRequest{Query: tc.query}, client)
+
+			t.Run("then it should leave it to the proxy", func(t *testing.T) {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if handled {
+					t.Fatal("expected the query not to be handled")
+				}
+				if len(client.queries) != queries {
+					t.Fatalf("expected no upstream queries, got %v", client.queries[queries:])
+				}
+			})
+		})
+	}
+}
@@ -1,20 +1,31 @@
 package usecase
 
 import (
+	"errors"
 	"fmt"
 	"log"
-	"regexp"
+	"math"
+	"slices"
 	"sort"
-	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/lucianocarvalho/labelify/internal/domain"
 	"github.com/lucianocarvalho/labelify/internal/infrastructure/sources"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/relabel"
+	"github.com/prometheus/prometheus/promql/parser"
 )
 
+var errMixedSamples = errors.New("encountered a mix of histograms and floats for aggregation")
+
 type EnrichmentUseCase struct {
 	config  *domain.Config
+	rules   []*enrichmentRule
 	sources map[string]domain.SourceProvider
+
+	indexes   map[string]*cachedIndex
+	indexesMu sync.Mutex
 }
 
 func NewEnrichmentUseCase(config *domain.Config) (*EnrichmentUseCase, error) {
@@ -29,240 +40,545 @@ func NewEnrichmentUseCase(config *domain.Config) (*EnrichmentUseCase, error) {
 		sourcesMap[source.Name] = provider
 	}
 
+	rules := make([]*enrichmentRule, 0, len(config.Enrichment.Rules))
+	for i, rule := range config.Enrichment.Rules {
+		compiled, err := compileRule(rule)
+		if err != nil {
+			return nil, fmt.Errorf("error compiling rule %d: %w", i, err)
+		}
+		rules = append(rules, compiled)
+	}
+
 	return &EnrichmentUseCase{
 		config:  config,
+		rules:   rules,
 		sources: sourcesMap,
+		indexes: make(map[string]*cachedIndex),
 	}, nil
 }
 
-func (h *EnrichmentUseCase) Execute(resp *domain.QueryResponse, originalQuery string) error {
-	if !h.hasApplicableRules(originalQuery, *resp) {
+func (h *EnrichmentUseCase) Execute(resp *domain.QueryResponse, request domain.QueryRequest) error {
+	originalQuery := request.Query
+
+	expr, err := parser.ParseExpr(originalQuery)
+	if err != nil {
+		// Prometheus can't run it either, so there's nothing to enrich.
+		return nil
+	}
+
+	matches := h.matchRules(expr)
+	if !h.hasApplicableRules(matches, *resp) {
 		return nil
 	}
 
 	log.Printf("Found applicable rules for query for query '%s': ", originalQuery)
 
-	if err := h.enrichMetrics(resp, originalQuery); err != nil {
+	mode := h.getMode(request, matches)
+	if err := h.enrichMetrics(resp, matches, h.splitsWeights(expr, matches, mode)); err != nil {
 		return err
 	}
 
-	allLabels := h.getAllLabels(originalQuery)
-	h.aggregateMetrics(resp, allLabels)
+	if mode == domain.EnrichmentModeKeep {
+		return nil
+	}
+
+	aggregation, err := h.getAggregation(expr, matches)
+	if err != nil {
+		h.addWarning(resp, err.Error())
+		return nil
+	}
+
+	allLabels, enrichedLabels := h.getAllLabels(expr, matches)
+	h.aggregateMetrics(resp, allLabels, enrichedLabels, aggregation)
 
 	return nil
 }
 
-func (h *EnrichmentUseCase) enrichMetrics(resp *domain.QueryResponse, originalQuery string) error {
-	for _, rule := range h.config.Enrichment.Rules {
-		log.Printf("Evaluating rule for metric: %s", rule.Match.Metric)
+func (h *EnrichmentUseCase) matchRules(expr parser.Expr) []*ruleMatch {
+	selectors := resultSelectors(expr)
 
-		source, ok := h.sources[rule.EnrichFrom]
-		if !ok {
-			log.Printf("Source %s not found for rule", rule.EnrichFrom)
-			continue
+	var matches []*ruleMatch
+	for _, rule := range h.rules {
+		match := &ruleMatch{rule: rule}
+		for _, vs := range selectors {
+			if rule.matchesSelector(vs) {
+				match.selectors = append(match.selectors, vs)
+			}
 		}
 
-		mappings, err := source.GetMappings()
-		if err != nil {
-			log.Printf("Error getting mappings from source %s: %v", rule.EnrichFrom, err)
-			continue
+		if len(match.selectors) > 0 {
+			matches = append(matches, match)
+		}
+	}
+	return matches
+}
+
+func (h *EnrichmentUseCase) enrichMetrics(resp *domain.QueryResponse, matches []*ruleMatch, weighted bool) error {
+	for _, match := range matches {
+		rule := match.rule
+		log.Printf("Evaluating rule for metric: %s", rule.Match.Metric)
+
+		// A candidate whose source can't be indexed is skipped.
+		indexes := make([]*mappingIndex, len(rule.candidates))
+		for i, candidate := range rule.candidates {
+			index, err := h.mappingIndex(candidate.EnrichFrom)
+			if err != nil {
+				log.Printf("Error indexing mappings for rule: %v", err)
+				continue
+			}
+			indexes[i] = index
 		}
 
-		h.applyRule(resp, &rule, mappings, originalQuery)
+		h.applyRule(resp, match, indexes, weighted)
 	}
 	return nil
 }
 
-func (h *EnrichmentUseCase) applyRule(resp *domain.QueryResponse, rule *domain.EnrichmentRule, mappings map[string]domain.SourceData, originalQuery string) {
-	for i, r := range resp.Data.Result {
-		if !h.matchesMetric(r.Metric, rule.Match, originalQuery) {
+func (h *EnrichmentUseCase) applyRule(resp *domain.QueryResponse, match *ruleMatch, indexes []*mappingIndex, weighted bool) {
+	rule := match.rule
+
+	result := make([]domain.MetricData, 0, len(resp.Data.Result))
+	for _, r := range resp.Data.Result {
+		if !match.matchesSeries(r.Metric) || !rule.appliesTo(r.Metric) {
+			result = append(result, r)
 			continue
 		}
 
-		labelValue := r.Metric[rule.Match.Label]
-		if labelValue == "" {
-			continue
+		series := []domain.MetricData{r}
+		matchedData, found := h.lookupCandidates(rule, indexes, r.Metric)
+		if found {
+			if !weighted && hasWeights(matchedData) {
+				h.addWarning(resp, "target weights were ignored, since the enriched series are not merged by summing them")
+			}
+			series = fanOut(r, matchedData, weighted)
+			for i, labelSet := range labelSets(matchedData) {
+				h.applyLabels(series[i].Metric, labelSet, rule)
+			}
+		}
+
+		for _, s := range series {
+			if len(rule.RelabelConfigs) > 0 && !relabelMetric(s.Metric, rule.RelabelConfigs) {
+				continue
+			}
+			if found && !match.matchesFilters(s.Metric) {
+				continue
+			}
+			result = append(result, s)
 		}
+	}
+
+	resp.Data.Result = result
+}
+
+// fanOut duplicates a series into each target of the matched mapping, its
+// values being split according to the target weights when weighted. The
+// series itself is kept as the first copy, since metric maps may be shared.
+func fanOut(r domain.MetricData, data *domain.SourceData, weighted bool) []domain.MetricData {
+	if data == nil || len(data.Targets) == 0 {
+		return []domain.MetricData{r}
+	}
 
-		matchedData := h.findMatchingData(labelValue, mappings)
-		h.applyLabels(resp, i, matchedData, rule)
+	series := make([]domain.MetricData, 0, len(data.Targets))
+	for i, target := range data.Targets {
+		c := r
+		if i > 0 {
+			c.Metric = make(map[string]string, len(r.Metric))
+			for name, value := range r.Metric {
+				c.Metric[name] = value
+			}
+		}
+		if weighted && target.Weight != nil {
+			c = scaleSeries(c, *target.Weight)
+		}
+		series = append(series, c)
 	}
+	return series
 }
 
-func (h *EnrichmentUseCase) findMatchingData(labelValue string, mappings map[string]domain.SourceData) *domain.SourceData {
-	for pattern, data := range mappings {
-		if pattern == labelValue {
-			return &data
+// labelSets returns the labels each copy of a series gets, nil meaning the
+// fallback.
+func labelSets(data *domain.SourceData) []map[string]string {
+	if data == nil {
+		return []map[string]string{nil}
+	}
+	return data.LabelSets()
+}
+
+// lookupCandidates looks up the rule labels in order, and returns the data
+// of the first mapping found. Series having none of the labels are left
+// alone, while the other ones get the fallback.
+func (h *EnrichmentUseCase) lookupCandidates(rule *enrichmentRule, indexes []*mappingIndex, metric map[string]string) (*domain.SourceData, bool) {
+	found := false
+	for i, candidate := range rule.candidates {
+		labelValue := extractKey(candidate.Extract, metric[candidate.Label])
+		if labelValue == "" || indexes[i] == nil {
+			continue
 		}
-		if matched, _ := regexp.MatchString(pattern, labelValue); matched {
-			return &data
+
+		found = true
+		if data := indexes[i].lookupSeries(labelValue, metric); data != nil {
+			return h.weighted(indexes[i], labelValue, metric, data), true
 		}
 	}
-	return nil
+	return nil, found
+}
+
+// relabelMetric runs the relabel steps on the series labels, in place since
+// metric maps may be shared. It returns false when the series is dropped.
+func relabelMetric(metric map[string]string, cfgs []*relabel.Config) bool {
+	relabeled, keep := relabel.Process(labels.FromMap(metric), cfgs...)
+	if !keep {
+		return false
+	}
+
+	for name := range metric {
+		delete(metric, name)
+	}
+	relabeled.Range(func(l labels.Label) {
+		metric[l.Name] = l.Value
+	})
+	return true
 }
 
-func (h *EnrichmentUseCase) applyLabels(resp *domain.QueryResponse, index int, matchedData *domain.SourceData, rule *domain.EnrichmentRule) {
-	if matchedData != nil {
+// applyLabels enriches a series with the labels of the matched mapping, or
+// with the fallback ones when matched is nil.
+func (h *EnrichmentUseCase) applyLabels(metric, matched map[string]string, rule *enrichmentRule) {
+	// Templates see the series labels as they were before being enriched.
+	if matched != nil {
+		data := templateData(metric, matched, rule.values)
 		for _, label := range rule.AddLabels {
-			if value, ok := matchedData.Labels[label]; ok {
-				resp.Data.Result[index].Metric[label] = value
+			if t, ok := rule.values[label.Name]; ok {
+				if value := t.render(data); value != "" {
+					metric[label.Name] = value
+				}
+			} else if value, ok := matched[label.Name]; ok {
+				metric[label.Name] = value
 			}
 		}
 	} else {
-		for label, value := range rule.Fallback {
-			resp.Data.Result[index].Metric[label] = value
+		data := templateData(metric, nil, rule.fallbacks)
+		for label, t := range rule.fallbacks {
+			if value := t.render(data); value != "" {
+				metric[label] = value
+			}
 		}
 	}
 }
 
-func (h *EnrichmentUseCase) aggregateMetrics(resp *domain.QueryResponse, allLabels []string) {
-	switch resp.Data.ResultType {
-	case "matrix":
-		h.aggregateMatrixMetrics(resp, allLabels)
-	case "vector":
-		h.aggregateVectorMetrics(resp, allLabels)
+type sampleSet struct {
+	floats     []float64
+	histograms []*histogram
+	// Last sample added, either a float64 or a *histogram.
+	last interface{}
+}
+
+type metricGroup struct {
+	labels  map[string]string
+	samples map[float64]*sampleSet
+}
+
+func (g *metricGroup) add(timestamp float64, sample interface{}) {
+	set, ok := g.samples[timestamp]
+	if !ok {
+		set = &sampleSet{}
+		g.samples[timestamp] = set
 	}
+
+	switch v := sample.(type) {
+	case float64:
+		set.floats = append(set.floats, v)
+	case *histogram:
+		set.histograms = append(set.histograms, v)
+	}
+	set.last = sample
 }
 
-func (h *EnrichmentUseCase) aggregateMatrixMetrics(resp *domain.QueryResponse, allLabels []string) {
-	groupedMetrics := make(map[string][][]interface{})
+func (h *EnrichmentUseCase) aggregateMetrics(resp *domain.QueryResponse, allLabels, enrichedLabels []string, aggregation domain.Aggregation) {
+	if resp.Data.ResultType != "matrix" && resp.Data.ResultType != "vector" {
+		return
+	}
+
+	groups := make(map[string]*metricGroup)
+	groupKeys := make([]string, 0)
+
 	for _, r := range resp.Data.Result {
-		groupKey := h.buildGroupKey(r.Metric, allLabels)
+		groupKey, labels := h.buildGroupKey(r.Metric, allLabels, enrichedLabels)
 		if groupKey == "" {
 			continue
 		}
 
-		if values, exists := groupedMetrics[groupKey]; exists {
-			h.mergeMatrixValues(values, r.Values)
-		} else {
-			groupedMetrics[groupKey] = r.Values
+		group, exists := groups[groupKey]
+		if !exists {
+			group = &metricGroup{labels: labels, samples: make(map[float64]*sampleSet)}
+			groups[groupKey] = group
+			groupKeys = append(groupKeys, groupKey)
+		}
+
+		h.collectSamples(resp, group, r)
+	}
+
+	result := make([]domain.MetricData, 0, len(groupKeys))
+	for _, groupKey := range groupKeys {
+		metric, ok := h.reduceGroup(resp, groups[groupKey], aggregation)
+		if ok {
+			result = append(result, metric)
 		}
 	}
 
-	resp.Data.Result = h.createMatrixResult(groupedMetrics)
+	resp.Data.Result = result
 }
 
-func (h *EnrichmentUseCase) aggregateVectorMetrics(resp *domain.QueryResponse, allLabels []string) {
-	groupedMetrics := make(map[string][]interface{})
-	for _, r := range resp.Data.Result {
-		groupKey := h.buildGroupKey(r.Metric, allLabels)
-		if groupKey == "" {
+func (h *EnrichmentUseCase) collectSamples(resp *domain.QueryResponse, group *metricGroup, r domain.MetricData) {
+	floats := r.Values
+	if len(r.Value) == 2 {
+		floats = append(floats, r.Value)
+	}
+
+	for _, sample := range floats {
+		value, err := parseSampleValue(sample[1])
+		if err != nil {
+			h.addWarning(resp, fmt.Sprintf("invalid sample value: %v", err))
 			continue
 		}
+		group.add(sample[0].(float64), value)
+	}
 
-		if value, exists := groupedMetrics[groupKey]; exists {
-			h.mergeVectorValues(value, r.Value)
-		} else {
-			groupedMetrics[groupKey] = r.Value
-		}
+	histograms := r.Histograms
+	if len(r.Histogram) == 2 {
+		histograms = append(histograms, r.Histogram)
 	}
 
-	resp.Data.Result = h.createVectorResult(groupedMetrics)
+	for _, sample := range histograms {
+		value, err := parseHistogram(sample[1])
+		if err != nil {
+			h.addWarning(resp, err.Error())
+			continue
+		}
+		group.add(sample[0].(float64), value)
+	}
 }
 
-func (h *EnrichmentUseCase) buildGroupKey(metric map[string]string, labels []string) string {
-	groupKey := make(map[string]string)
-	for _, label := range labels {
-		if value, ok := metric[label]; ok {
-			groupKey[label] = value
+func (h *EnrichmentUseCase) reduceGroup(resp *domain.QueryResponse, group *metricGroup, aggregation domain.Aggregation) (domain.MetricData, bool) {
+	timestamps := make([]float64, 0, len(group.samples))
+	for timestamp := range group.samples {
+		timestamps = append(timestamps, timestamp)
+	}
+	sort.Float64s(timestamps)
+
+	metric := domain.MetricData{Metric: group.labels}
+	for _, timestamp := range timestamps {
+		value, err := reduceSamples(group.samples[timestamp], aggregation)
+		if err != nil {
+			h.addWarning(resp, fmt.Sprintf("%v for {%s}, samples were dropped", err, h.createGroupKey(group.labels)))
+			continue
+		}
+
+		switch v := value.(type) {
+		case float64:
+			metric.Values = append(metric.Values, []interface{}{timestamp, formatSampleValue(v)})
+		case *histogram:
+			metric.Histograms = append(metric.Histograms, []interface{}{timestamp, v.format()})
 		}
 	}
 
-	if len(groupKey) == 0 {
-		return ""
+	if resp.Data.ResultType == "vector" {
+		if len(metric.Values) > 0 {
+			metric.Value = metric.Values[0]
+		}
+		if len(metric.Histograms) > 0 {
+			metric.Histogram = metric.Histograms[0]
+		}
+		metric.Values, metric.Histograms = nil, nil
 	}
 
-	return h.createGroupKey(groupKey)
+	empty := len(metric.Value) == 0 && len(metric.Values) == 0 && len(metric.Histogram) == 0 && len(metric.Histograms) == 0
+	return metric, !empty
 }
 
-func (h *EnrichmentUseCase) mergeMatrixValues(existing, values [][]interface{}) {
-	for i, v := range values {
-		if i >= len(existing) {
-			existing = append(existing, v)
-		} else {
-			val1, _ := strconv.Atoi(v[1].(string))
-			val2, _ := strconv.Atoi(existing[i][1].(string))
-			existing[i][1] = strconv.Itoa(val1 + val2)
-		}
+func reduceSamples(set *sampleSet, aggregation domain.Aggregation) (interface{}, error) {
+	total := len(set.floats) + len(set.histograms)
+
+	switch aggregation {
+	case domain.AggregationCount:
+		return float64(total), nil
+	case domain.AggregationGroup:
+		return float64(1), nil
+	case domain.AggregationLast:
+		return set.last, nil
+	}
+
+	if len(set.floats) > 0 && len(set.histograms) > 0 {
+		return nil, errMixedSamples
 	}
-}
 
-func (h *EnrichmentUseCase) mergeVectorValues(existing, values []interface{}) {
-	val1, _ := strconv.Atoi(values[1].(string))
-	val2, _ := strconv.Atoi(existing[1].(string))
-	existing[1] = strconv.Itoa(val1 + val2)
+	if len(set.histograms) > 0 {
+		return reduceHistograms(set.histograms, aggregation)
+	}
+
+	return reduceFloats(set.floats, aggregation), nil
 }
 
-func (h *EnrichmentUseCase) createMatrixResult(groupedMetrics map[string][][]interface{}) []domain.MetricData {
-	result := make([]domain.MetricData, 0, len(groupedMetrics))
-	for groupKey, values := range groupedMetrics {
-		result = append(result, domain.MetricData{
-			Metric: h.parseGroupKey(groupKey),
-			Values: values,
-		})
+func reduceFloats(values []float64, aggregation domain.Aggregation) float64 {
+	result := values[0]
+
+	for _, value := range values[1:] {
+		switch aggregation {
+		case domain.AggregationMin:
+			// NaN is only returned when all values are NaN.
+			if value < result || math.IsNaN(result) {
+				result = value
+			}
+		case domain.AggregationMax:
+			if value > result || math.IsNaN(result) {
+				result = value
+			}
+		default:
+			result += value
+		}
+	}
+
+	if aggregation == domain.AggregationAvg {
+		result /= float64(len(values))
 	}
+
 	return result
 }
 
-func (h *EnrichmentUseCase) createVectorResult(groupedMetrics map[string][]interface{}) []domain.MetricData {
-	result := make([]domain.MetricData, 0, len(groupedMetrics))
-	for groupKey, value := range groupedMetrics {
-		result = append(result, domain.MetricData{
-			Metric: h.parseGroupKey(groupKey),
-			Value:  value,
-		})
+func reduceHistograms(values []*histogram, aggregation domain.Aggregation) (*histogram, error) {
+	if aggregation != domain.AggregationSum && aggregation != domain.AggregationAvg && aggregation != "" {
+		return nil, fmt.Errorf("aggregation %s is not supported for native histograms", aggregation)
 	}
-	return result
+
+	result := values[0].clone()
+	for _, value := range values[1:] {
+		if err := result.add(value); err != nil {
+			return nil, err
+		}
+	}
+
+	if aggregation == domain.AggregationAvg {
+		result.scale(1 / float64(len(values)))
+	}
+
+	return result, nil
 }
 
-func (h *EnrichmentUseCase) parseGroupKey(groupKey string) map[string]string {
-	metric := make(map[string]string)
-	for _, pair := range strings.Split(groupKey, ",") {
-		if pair == "" {
-			continue
+func (h *EnrichmentUseCase) buildGroupKey(metric map[string]string, labels, enrichedLabels []string) (string, map[string]string) {
+	groupKey := make(map[string]string)
+	for _, label := range labels {
+		if value, ok := metric[label]; ok {
+			groupKey[label] = value
 		}
-		parts := strings.Split(pair, "=")
-		if len(parts) == 2 {
-			metric[parts[0]] = parts[1]
+	}
+
+	// Series that weren't enriched at all are left out.
+	enriched := false
+	for _, label := range enrichedLabels {
+		if _, ok := groupKey[label]; ok {
+			enriched = true
+			break
 		}
 	}
-	return metric
+
+	if !enriched {
+		return "", nil
+	}
+
+	return h.createGroupKey(groupKey), groupKey
 }
 
-func (h *EnrichmentUseCase) hasApplicableRules(query string, resp domain.QueryResponse) bool {
-	for _, rule := range h.config.Enrichment.Rules {
-		if !strings.Contains(query, rule.Match.Metric) {
-			continue
-		}
+func (h *EnrichmentUseCase) addWarning(resp *domain.QueryResponse, warning string) {
+	if slices.Contains(resp.Warnings, warning) {
+		return
+	}
+	log.Printf("Warning: %s", warning)
+	resp.Warnings = append(resp.Warnings, warning)
+}
 
+func (h *EnrichmentUseCase) hasApplicableRules(matches []*ruleMatch, resp domain.QueryResponse) bool {
+	for _, match := range matches {
 		for _, r := range resp.Data.Result {
-			if _, ok := r.Metric[rule.Match.Label]; ok {
-				return true
+			for _, label := range match.rule.candidateLabels() {
+				if _, ok := r.Metric[label]; ok {
+					return true
+				}
 			}
 		}
 	}
 	return false
 }
 
-func (h *EnrichmentUseCase) getAllLabels(query string) []string {
-	labelSet := make(map[string]bool)
-	for _, rule := range h.config.Enrichment.Rules {
-		if strings.Contains(query, rule.Match.Metric) {
-			for _, label := range rule.AddLabels {
-				labelSet[label] = true
+// getAllLabels returns the labels used to group the enriched series: the
+// query's own by() labels, minus the source labels of the rules, plus the
+// enriched ones.
+func (h *EnrichmentUseCase) getAllLabels(expr parser.Expr, matches []*ruleMatch) ([]string, []string) {
+	enrichedSet := make(map[string]bool)
+	sourceSet := make(map[string]bool)
+	for _, match := range matches {
+		for _, label := range match.rule.enrichedLabels() {
+			enrichedSet[label] = true
+		}
+		for _, label := range match.rule.candidateLabels() {
+			sourceSet[label] = true
+		}
+	}
+
+	enrichedLabels := sortedKeys(enrichedSet)
+	labels := append([]string(nil), enrichedLabels...)
+
+	if aggregate := outermostAggregation(expr); aggregate != nil && !aggregate.Without {
+		for _, label := range aggregate.Grouping {
+			if !sourceSet[label] && !enrichedSet[label] {
+				labels = append(labels, label)
 			}
 		}
 	}
 
-	labels := make([]string, 0, len(labelSet))
-	for label := range labelSet {
-		labels = append(labels, label)
+	return labels, enrichedLabels
+}
+
+func (h *EnrichmentUseCase) getMode(request domain.QueryRequest, matches []*ruleMatch) domain.EnrichmentMode {
+	if request.Mode != "" {
+		return request.Mode
+	}
+
+	for _, match := range matches {
+		if match.rule.Mode != "" {
+			return match.rule.Mode
+		}
+	}
+	return domain.EnrichmentModeAggregate
+}
+
+// splitsWeights tells whether the values of fanned out series are split by
+// the target weights, which only adds up when the enriched series are
+// merged by summing their values.
+func (h *EnrichmentUseCase) splitsWeights(expr parser.Expr, matches []*ruleMatch, mode domain.EnrichmentMode) bool {
+	if mode == domain.EnrichmentModeKeep {
+		return false
 	}
-	return labels
+
+	// Counts are merged by summing them too, but they count series.
+	if aggregate := outermostAggregation(expr); aggregate != nil {
+		return aggregate.Op == parser.SUM
+	}
+
+	aggregation, err := h.getAggregation(expr, matches)
+	return err == nil && aggregation == domain.AggregationSum
 }
 
-func (h *EnrichmentUseCase) matchesMetric(metric map[string]string, match domain.MatchRule, query string) bool {
-	return strings.Contains(query, match.Metric)
+func (h *EnrichmentUseCase) getAggregation(expr parser.Expr, matches []*ruleMatch) (domain.Aggregation, error) {
+	// The outermost aggregation of the query tells how the groups must be merged.
+	if aggregate := outermostAggregation(expr); aggregate != nil {
+		return mergeAggregation(aggregate.Op)
+	}
+
+	for _, match := range matches {
+		if match.rule.Aggregation != "" {
+			return match.rule.Aggregation, nil
+		}
+	}
+	return domain.AggregationSum, nil
 }
 
 func (h *EnrichmentUseCase) createGroupKey(groupKey map[string]string) string {
@@ -274,7 +590,7 @@ func (h *EnrichmentUseCase) createGroupKey(groupKey map[string]string) string {
 
 	parts := make([]string, 0, len(keys))
 	for _, k := range keys {
-		parts = append(parts, fmt.Sprintf("%s=%s", k, groupKey[k]))
+		parts = append(parts, fmt.Sprintf("%s=%q", k, groupKey[k]))
 	}
 	return strings.Join(parts, ",")
 }
@@ -5,6 +5,7 @@ import (
 	"testing"
 
 	"github.com/lucianocarvalho/labelify/internal/domain"
+	"gopkg.in/yaml.v3"
 )
 
 func TestEnrichmentUseCase_Execute(t *testing.T) {
@@ -50,7 +51,7 @@ func TestEnrichmentUseCase_Execute(t *testing.T) {
 				{
 					Match:      domain.MatchRule{Metric: "kube_deployment_spec_replicas", Label: "deployment"},
 					EnrichFrom: "just-a-random-source",
-					AddLabels:  []string{"team"},
+					AddLabels:  domain.AddLabels{{Name: "team"}},
 				},
 			},
 		}
@@ -61,10 +62,13 @@ func TestEnrichmentUseCase_Execute(t *testing.T) {
 				{
 					Name: "just-a-random-source",
 					Type: "yaml",
-					Mappings: map[string]domain.SourceData{
-						"coredns": {
-							Labels: map[string]string{
-								"team": "networking",
+					Mappings: domain.Mappings{
+						{
+							Pattern: "coredns",
+							SourceData: domain.SourceData{
+								Labels: map[string]string{
+									"team": "networking",
+								},
 							},
 						},
 					},
@@ -81,7 +85,7 @@ func TestEnrichmentUseCase_Execute(t *testing.T) {
 				t.Fatal(err)
 			}
 
-			err = uc.Execute(&response, query)
+			err = uc.Execute(&response, domain.QueryRequest{Query: query})
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -117,10 +121,13 @@ func TestEnrichmentUseCase_Execute(t *testing.T) {
 				{
 					Name: "just-a-random-source",
 					Type: "yaml",
-					Mappings: map[string]domain.SourceData{
-						"microservice-.*": {
-							Labels: map[string]string{
-								"team": "engineering",
+					Mappings: domain.Mappings{
+						{
+							Pattern: "microservice-.*",
+							SourceData: domain.SourceData{
+								Labels: map[string]string{
+									"team": "engineering",
+								},
 							},
 						},
 					},
@@ -137,7 +144,7 @@ func TestEnrichmentUseCase_Execute(t *testing.T) {
 				t.Fatal(err)
 			}
 
-			err = uc.Execute(&response, query)
+			err = uc.Execute(&response, domain.QueryRequest{Query: query})
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -173,15 +180,21 @@ func TestEnrichmentUseCase_Execute(t *testing.T) {
 				{
 					Name: "just-a-random-source",
 					Type: "yaml",
-					Mappings: map[string]domain.SourceData{
-						"microservice-.*": {
-							Labels: map[string]string{
-								"team": "engineering",
+					Mappings: domain.Mappings{
+						{
+							Pattern: "microservice-.*",
+							SourceData: domain.SourceData{
+								Labels: map[string]string{
+									"team": "engineering",
+								},
 							},
 						},
-						"coredns": {
-							Labels: map[string]string{
-								"team": "networking",
+						{
+							Pattern: "coredns",
+							SourceData: domain.SourceData{
+								Labels: map[string]string{
+									"team": "networking",
+								},
 							},
 						},
 					},
@@ -198,7 +211,7 @@ func TestEnrichmentUseCase_Execute(t *testing.T) {
 				t.Fatal(err)
 			}
 
-			err = uc.Execute(&response, query)
+			err = uc.Execute(&response, domain.QueryRequest{Query: query})
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -243,11 +256,14 @@ func TestEnrichmentUseCase_Execute(t *testing.T) {
 				{
 					Name: "just-a-random-source",
 					Type: "yaml",
-					Mappings: map[string]domain.SourceData{
-						"coredns": {
-							Labels: map[string]string{
-								"team":          "networking",
-								"business_unit": "foundation",
+					Mappings: domain.Mappings{
+						{
+							Pattern: "coredns",
+							SourceData: domain.SourceData{
+								Labels: map[string]string{
+									"team":          "networking",
+									"business_unit": "foundation",
+								},
 							},
 						},
 					},
@@ -264,7 +280,7 @@ func TestEnrichmentUseCase_Execute(t *testing.T) {
 				t.Fatal(err)
 			}
 
-			err = uc.Execute(&response, query)
+			err = uc.Execute(&response, domain.QueryRequest{Query: query})
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -303,7 +319,7 @@ func TestEnrichmentUseCase_Execute(t *testing.T) {
 				{
 					Match:      domain.MatchRule{Metric: "kube_deployment_spec_replicas", Label: "deployment"},
 					EnrichFrom: "just-a-random-source",
-					AddLabels:  []string{"team"},
+					AddLabels:  domain.AddLabels{{Name: "team"}},
 					// Fallback is used when the source does not have a match.
 					Fallback: map[string]string{
 						"team": "unknown",
@@ -318,10 +334,13 @@ func TestEnrichmentUseCase_Execute(t *testing.T) {
 				{
 					Name: "just-a-random-source",
 					Type: "yaml",
-					Mappings: map[string]domain.SourceData{
-						"coredns": {
-							Labels: map[string]string{
-								"team": "networking",
+					Mappings: domain.Mappings{
+						{
+							Pattern: "coredns",
+							SourceData: domain.SourceData{
+								Labels: map[string]string{
+									"team": "networking",
+								},
 							},
 						},
 					},
@@ -338,7 +357,7 @@ func TestEnrichmentUseCase_Execute(t *testing.T) {
 				t.Fatal(err)
 			}
 
-			err = uc.Execute(&response, query)
+			err = uc.Execute(&response, domain.QueryRequest{Query: query})
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -378,3 +397,1265 @@ func TestEnrichmentUseCase_Execute(t *testing.T) {
 		})
 	})
 }
+
+func TestEnrichmentUseCase_Execute_FloatValues(t *testing.T) {
+	query := "sum(rate(container_cpu_usage_seconds_total[5m])) by (deployment)"
+
+	config := &domain.Config{
+		Sources: []domain.Source{
+			{
+				Name: "just-a-random-source",
+				Type: "yaml",
+				Mappings: domain.Mappings{
+					{
+						Pattern: "microservice-.*",
+						SourceData: domain.SourceData{
+							Labels: map[string]string{
+								"team": "engineering",
+							},
+						},
+					},
+					{
+						Pattern: "coredns",
+						SourceData: domain.SourceData{
+							Labels: map[string]string{
+								"team": "networking",
+							},
+						},
+					},
+					{
+						Pattern: "prometheus-.*",
+						SourceData: domain.SourceData{
+							Labels: map[string]string{
+								"team": "observability",
+							},
+						},
+					},
+				},
+			},
+		},
+		Enrichment: domain.Enrichment{
+			Rules: []domain.EnrichmentRule{
+				{
+					Match:      domain.MatchRule{Metric: "container_cpu_usage_seconds_total", Label: "deployment"},
+					EnrichFrom: "just-a-random-source",
+					AddLabels:  domain.AddLabels{{Name: "team"}},
+				},
+			},
+		},
+	}
+
+	t.Run("given an instant vector with fractional, NaN and Inf values", func(t *testing.T) {
+		response := domain.QueryResponse{
+			Status: "success",
+			Data: domain.QueryData{
+				ResultType: "vector",
+				Result: []domain.MetricData{
+					{Metric: map[string]string{"deployment": "microservice-1"}, Value: []interface{}{float64(182778586), "0.25"}},
+					{Metric: map[string]string{"deployment": "microservice-2"}, Value: []interface{}{float64(182778586), "1.5"}},
+					{Metric: map[string]string{"deployment": "coredns"}, Value: []interface{}{float64(182778586), "NaN"}},
+					{Metric: map[string]string{"deployment": "coredns"}, Value: []interface{}{float64(182778586), "1"}},
+					{Metric: map[string]string{"deployment": "prometheus-grafana"}, Value: []interface{}{float64(182778586), "+Inf"}},
+					{Metric: map[string]string{"deployment": "prometheus-operator"}, Value: []interface{}{float64(182778586), "2"}},
+				},
+			},
+		}
+
+		uc, err := NewEnrichmentUseCase(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := uc.Execute(&response, domain.QueryRequest{Query: query}); err != nil {
+			t.Fatal(err)
+		}
+
+		t.Run("then it should sum them as floats, formatted like Prometheus", func(t *testing.T) {
+			expected := []domain.MetricData{
+				{Metric: map[string]string{"team": "engineering"}, Value: []interface{}{float64(182778586), "1.75"}},
+				{Metric: map[string]string{"team": "networking"}, Value: []interface{}{float64(182778586), "NaN"}},
+				{Metric: map[string]string{"team": "observability"}, Value: []interface{}{float64(182778586), "+Inf"}},
+			}
+
+			if !reflect.DeepEqual(response.Data.Result, expected) {
+				t.Fatalf("expected %+v, got %+v", expected, response.Data.Result)
+			}
+		})
+	})
+}
+
+func TestEnrichmentUseCase_Execute_RangeVector(t *testing.T) {
+	query := "sum(kube_deployment_spec_replicas) by (deployment)"
+
+	config := &domain.Config{
+		Sources: []domain.Source{
+			{
+				Name: "just-a-random-source",
+				Type: "yaml",
+				Mappings: domain.Mappings{
+					{
+						Pattern: "microservice-.*",
+						SourceData: domain.SourceData{
+							Labels: map[string]string{
+								"team": "engineering",
+							},
+						},
+					},
+				},
+			},
+		},
+		Enrichment: domain.Enrichment{
+			Rules: []domain.EnrichmentRule{
+				{
+					Match:      domain.MatchRule{Metric: "kube_deployment_spec_replicas", Label: "deployment"},
+					EnrichFrom: "just-a-random-source",
+					AddLabels:  domain.AddLabels{{Name: "team"}},
+				},
+			},
+		},
+	}
+
+	t.Run("given a range vector with series of different lengths and gaps", func(t *testing.T) {
+		response := domain.QueryResponse{
+			Status: "success",
+			Data: domain.QueryData{
+				ResultType: "matrix",
+				Result: []domain.MetricData{
+					{
+						Metric: map[string]string{"deployment": "microservice-1"},
+						Values: [][]interface{}{
+							{float64(100), "1"},
+							{float64(130), "1"},
+						},
+					},
+					{
+						// Starts late and has a gap at 115.
+						Metric: map[string]string{"deployment": "microservice-2"},
+						Values: [][]interface{}{
+							{float64(115), "2"},
+							{float64(130), "2"},
+							{float64(145), "2"},
+						},
+					},
+					{
+						Metric: map[string]string{"deployment": "microservice-3"},
+						Values: [][]interface{}{
+							{float64(100), "0.5"},
+						},
+					},
+				},
+			},
+		}
+
+		uc, err := NewEnrichmentUseCase(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := uc.Execute(&response, domain.QueryRequest{Query: query}); err != nil {
+			t.Fatal(err)
+		}
+
+		t.Run("then it should merge samples by timestamp, ordered and without losing points", func(t *testing.T) {
+			expected := []domain.MetricData{
+				{
+					Metric: map[string]string{"team": "engineering"},
+					Values: [][]interface{}{
+						{float64(100), "1.5"},
+						{float64(115), "2"},
+						{float64(130), "3"},
+						{float64(145), "2"},
+					},
+				},
+			}
+
+			if !reflect.DeepEqual(response.Data.Result, expected) {
+				t.Fatalf("expected %+v, got %+v", expected, response.Data.Result)
+			}
+		})
+	})
+}
+
+func TestEnrichmentUseCase_Execute_Aggregation(t *testing.T) {
+	query := "container_memory_working_set_bytes"
+
+	createResponse := func() domain.QueryResponse {
+		return domain.QueryResponse{
+			Status: "success",
+			Data: domain.QueryData{
+				ResultType: "vector",
+				Result: []domain.MetricData{
+					{Metric: map[string]string{"pod": "microservice-1"}, Value: []interface{}{float64(182778586), "2"}},
+					{Metric: map[string]string{"pod": "microservice-2"}, Value: []interface{}{float64(182778586), "7"}},
+					{Metric: map[string]string{"pod": "microservice-3"}, Value: []interface{}{float64(182778586), "3"}},
+				},
+			},
+		}
+	}
+
+	expectedValues := map[domain.Aggregation]string{
+		"":                      "12",
+		domain.AggregationSum:   "12",
+		domain.AggregationMin:   "2",
+		domain.AggregationMax:   "7",
+		domain.AggregationCount: "3",
+		domain.AggregationAvg:   "4",
+		domain.AggregationGroup: "1",
+		domain.AggregationLast:  "3",
+	}
+
+	for aggregation, expectedValue := range expectedValues {
+		t.Run("given a rule using the "+string(aggregation)+" aggregation", func(t *testing.T) {
+			response := createResponse()
+			config := &domain.Config{
+				Sources: []domain.Source{
+					{
+						Name: "just-a-random-source",
+						Type: "yaml",
+						Mappings: domain.Mappings{
+							{
+								Pattern: "microservice-.*",
+								SourceData: domain.SourceData{
+									Labels: map[string]string{
+										"team": "engineering",
+									},
+								},
+							},
+						},
+					},
+				},
+				Enrichment: domain.Enrichment{
+					Rules: []domain.EnrichmentRule{
+						{
+							Match:       domain.MatchRule{Metric: "container_memory_working_set_bytes", Label: "pod"},
+							EnrichFrom:  "just-a-random-source",
+							AddLabels:   domain.AddLabels{{Name: "team"}},
+							Aggregation: aggregation,
+						},
+					},
+				},
+			}
+
+			uc, err := NewEnrichmentUseCase(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := uc.Execute(&response, domain.QueryRequest{Query: query}); err != nil {
+				t.Fatal(err)
+			}
+
+			t.Run("then it should combine the grouped series with it", func(t *testing.T) {
+				expected := []domain.MetricData{
+					{Metric: map[string]string{"team": "engineering"}, Value: []interface{}{float64(182778586), expectedValue}},
+				}
+
+				if !reflect.DeepEqual(response.Data.Result, expected) {
+					t.Fatalf("expected %+v, got %+v", expected, response.Data.Result)
+				}
+			})
+		})
+	}
+}
+
+func TestEnrichmentUseCase_Execute_InferredAggregation(t *testing.T) {
+	createResponse := func() domain.QueryResponse {
+		return domain.QueryResponse{
+			Status: "success",
+			Data: domain.QueryData{
+				ResultType: "vector",
+				Result: []domain.MetricData{
+					{Metric: map[string]string{"deployment": "microservice-1"}, Value: []interface{}{float64(182778586), "2"}},
+					{Metric: map[string]string{"deployment": "microservice-2"}, Value: []interface{}{float64(182778586), "7"}},
+				},
+			},
+		}
+	}
+
+	config := &domain.Config{
+		Sources: []domain.Source{
+			{
+				Name: "just-a-random-source",
+				Type: "yaml",
+				Mappings: domain.Mappings{
+					{
+						Pattern: "microservice-.*",
+						SourceData: domain.SourceData{
+							Labels: map[string]string{
+								"team": "engineering",
+							},
+						},
+					},
+				},
+			},
+		},
+		Enrichment: domain.Enrichment{
+			Rules: []domain.EnrichmentRule{
+				{
+					Match:      domain.MatchRule{Metric: "kube_deployment_spec_replicas", Label: "deployment"},
+					EnrichFrom: "just-a-random-source",
+					AddLabels:  domain.AddLabels{{Name: "team"}},
+					// The query's aggregation takes precedence over the rule one.
+					Aggregation: domain.AggregationSum,
+				},
+			},
+		},
+	}
+
+	uc, err := NewEnrichmentUseCase(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("given a query aggregated with max", func(t *testing.T) {
+		response := createResponse()
+		if err := uc.Execute(&response, domain.QueryRequest{Query: "max(kube_deployment_spec_replicas) by (deployment)"}); err != nil {
+			t.Fatal(err)
+		}
+
+		t.Run("then it should merge the groups with max", func(t *testing.T) {
+			expected := []domain.MetricData{
+				{Metric: map[string]string{"team": "engineering"}, Value: []interface{}{float64(182778586), "7"}},
+			}
+
+			if !reflect.DeepEqual(response.Data.Result, expected) {
+				t.Fatalf("expected %+v, got %+v", expected, response.Data.Result)
+			}
+		})
+	})
+
+	t.Run("given a query aggregated with count", func(t *testing.T) {
+		response := createResponse()
+		if err := uc.Execute(&response, domain.QueryRequest{Query: "(count by (deployment) (kube_deployment_spec_replicas))"}); err != nil {
+			t.Fatal(err)
+		}
+
+		t.Run("then it should merge the groups adding the counts", func(t *testing.T) {
+			expected := []domain.MetricData{
+				{Metric: map[string]string{"team": "engineering"}, Value: []interface{}{float64(182778586), "9"}},
+			}
+
+			if !reflect.DeepEqual(response.Data.Result, expected) {
+				t.Fatalf("expected %+v, got %+v", expected, response.Data.Result)
+			}
+		})
+	})
+
+	t.Run("given a query aggregated with avg", func(t *testing.T) {
+		response := createResponse()
+		if err := uc.Execute(&response, domain.QueryRequest{Query: "avg(kube_deployment_spec_replicas) by (deployment)"}); err != nil {
+			t.Fatal(err)
+		}
+
+		t.Run("then it should not regroup the enriched series", func(t *testing.T) {
+			expected := []domain.MetricData{
+				{Metric: map[string]string{"deployment": "microservice-1", "team": "engineering"}, Value: []interface{}{float64(182778586), "2"}},
+				{Metric: map[string]string{"deployment": "microservice-2", "team": "engineering"}, Value: []interface{}{float64(182778586), "7"}},
+			}
+
+			if !reflect.DeepEqual(response.Data.Result, expected) {
+				t.Fatalf("expected %+v, got %+v", expected, response.Data.Result)
+			}
+		})
+
+		t.Run("then it should return a warning", func(t *testing.T) {
+			if len(response.Warnings) != 1 {
+				t.Fatalf("expected 1 warning, got %+v", response.Warnings)
+			}
+		})
+	})
+}
+
+func TestEnrichmentUseCase_Execute_KeepMode(t *testing.T) {
+	query := "sum(kube_pod_container_resource_requests) by (deployment, namespace, pod)"
+
+	createResponse := func() domain.QueryResponse {
+		return domain.QueryResponse{
+			Status: "success",
+			Data: domain.QueryData{
+				ResultType: "vector",
+				Result: []domain.MetricData{
+					{Metric: map[string]string{"deployment": "microservice-1", "namespace": "default", "pod": "microservice-1-abc"}, Value: []interface{}{float64(182778586), "2"}},
+					{Metric: map[string]string{"deployment": "microservice-2", "namespace": "default", "pod": "microservice-2-def"}, Value: []interface{}{float64(182778586), "3"}},
+					{Metric: map[string]string{"deployment": "coredns", "namespace": "kube-system", "pod": "coredns-ghi"}, Value: []interface{}{float64(182778586), "1"}},
+				},
+			},
+		}
+	}
+
+	expected := []domain.MetricData{
+		{Metric: map[string]string{"deployment": "microservice-1", "namespace": "default", "pod": "microservice-1-abc", "team": "engineering"}, Value: []interface{}{float64(182778586), "2"}},
+		{Metric: map[string]string{"deployment": "microservice-2", "namespace": "default", "pod": "microservice-2-def", "team": "engineering"}, Value: []interface{}{float64(182778586), "3"}},
+		{Metric: map[string]string{"deployment": "coredns", "namespace": "kube-system", "pod": "coredns-ghi"}, Value: []interface{}{float64(182778586), "1"}},
+	}
+
+	createConfig := func(mode domain.EnrichmentMode) *domain.Config {
+		return &domain.Config{
+			Sources: []domain.Source{
+				{
+					Name: "just-a-random-source",
+					Type: "yaml",
+					Mappings: domain.Mappings{
+						{
+							Pattern: "microservice-.*",
+							SourceData: domain.SourceData{
+								Labels: map[string]string{
+									"team": "engineering",
+								},
+							},
+						},
+					},
+				},
+			},
+			Enrichment: domain.Enrichment{
+				Rules: []domain.EnrichmentRule{
+					{
+						Match:      domain.MatchRule{Metric: "kube_pod_container_resource_requests", Label: "deployment"},
+						EnrichFrom: "just-a-random-source",
+						AddLabels:  domain.AddLabels{{Name: "team"}},
+						Mode:       mode,
+					},
+				},
+			},
+		}
+	}
+
+	t.Run("given a rule using the keep mode", func(t *testing.T) {
+		response := createResponse()
+
+		uc, err := NewEnrichmentUseCase(createConfig(domain.EnrichmentModeKeep))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := uc.Execute(&response, domain.QueryRequest{Query: query}); err != nil {
+			t.Fatal(err)
+		}
+
+		t.Run("then it should append the enriched labels without collapsing the series", func(t *testing.T) {
+			if !reflect.DeepEqual(response.Data.Result, expected) {
+				t.Fatalf("expected %+v, got %+v", expected, response.Data.Result)
+			}
+		})
+	})
+
+	t.Run("given a request using the keep mode", func(t *testing.T) {
+		response := createResponse()
+
+		uc, err := NewEnrichmentUseCase(createConfig(""))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := uc.Execute(&response, domain.QueryRequest{Query: query, Mode: domain.EnrichmentModeKeep}); err != nil {
+			t.Fatal(err)
+		}
+
+		t.Run("then it should take precedence over the rule mode", func(t *testing.T) {
+			if !reflect.DeepEqual(response.Data.Result, expected) {
+				t.Fatalf("expected %+v, got %+v", expected, response.Data.Result)
+			}
+		})
+	})
+}
+
+func TestEnrichmentUseCase_Execute_GroupingLabels(t *testing.T) {
+	config := &domain.Config{
+		Sources: []domain.Source{
+			{
+				Name: "just-a-random-source",
+				Type: "yaml",
+				Mappings: domain.Mappings{
+					{
+						Pattern: "microservice-.*",
+						SourceData: domain.SourceData{
+							Labels: map[string]string{
+								"team": "engineering",
+							},
+						},
+					},
+				},
+			},
+		},
+		Enrichment: domain.Enrichment{
+			Rules: []domain.EnrichmentRule{
+				{
+					Match:      domain.MatchRule{Metric: "kube_deployment_spec_replicas", Label: "deployment"},
+					EnrichFrom: "just-a-random-source",
+					AddLabels:  domain.AddLabels{{Name: "team"}},
+				},
+			},
+		},
+	}
+
+	t.Run("given a query grouped by deployment and namespace", func(t *testing.T) {
+		query := "sum(kube_deployment_spec_replicas) by (deployment, namespace)"
+
+		response := domain.QueryResponse{
+			Status: "success",
+			Data: domain.QueryData{
+				ResultType: "vector",
+				Result: []domain.MetricData{
+					{Metric: map[string]string{"deployment": "microservice-1", "namespace": "default"}, Value: []interface{}{float64(182778586), "1"}},
+					{Metric: map[string]string{"deployment": "microservice-2", "namespace": "default"}, Value: []interface{}{float64(182778586), "2"}},
+					{Metric: map[string]string{"deployment": "microservice-1", "namespace": "staging"}, Value: []interface{}{float64(182778586), "4"}},
+					{Metric: map[string]string{"deployment": "coredns", "namespace": "kube-system"}, Value: []interface{}{float64(182778586), "8"}},
+				},
+			},
+		}
+
+		uc, err := NewEnrichmentUseCase(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := uc.Execute(&response, domain.QueryRequest{Query: query}); err != nil {
+			t.Fatal(err)
+		}
+
+		t.Run("then it should group by namespace and team", func(t *testing.T) {
+			expected := []domain.MetricData{
+				{Metric: map[string]string{"namespace": "default", "team": "engineering"}, Value: []interface{}{float64(182778586), "3"}},
+				{Metric: map[string]string{"namespace": "staging", "team": "engineering"}, Value: []interface{}{float64(182778586), "4"}},
+			}
+
+			if !reflect.DeepEqual(response.Data.Result, expected) {
+				t.Fatalf("expected %+v, got %+v", expected, response.Data.Result)
+			}
+		})
+	})
+}
+
+func TestEnrichmentUseCase_Execute_Templates(t *testing.T) {
+	config := &domain.Config{
+		Sources: []domain.Source{
+			{
+				Name: "just-a-random-source",
+				Type: "yaml",
+				Mappings: domain.Mappings{
+					{
+						Pattern: "microservice-.*",
+						SourceData: domain.SourceData{
+							Labels: map[string]string{
+								"team": "Engineering",
+							},
+						},
+					},
+				},
+			},
+		},
+		Enrichment: domain.Enrichment{
+			Rules: []domain.EnrichmentRule{
+				{
+					Match:      domain.MatchRule{Metric: "kube_pod_container_resource_requests", Label: "deployment"},
+					EnrichFrom: "just-a-random-source",
+					AddLabels: domain.AddLabels{
+						{Name: "team", Value: "{{ .Mapping.team | lower }}"},
+						{Name: "owner", Value: `{{ .namespace | default "nobody" }}/{{ .deployment | regexReplace "-[0-9]+$" "" }}`},
+					},
+					Fallback: map[string]string{
+						"team":  "unowned-{{ .namespace }}",
+						"owner": "{{ .missing }}",
+					},
+					Mode: domain.EnrichmentModeKeep,
+				},
+			},
+		},
+	}
+
+	uc, err := NewEnrichmentUseCase(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("given series with and without a mapping", func(t *testing.T) {
+		response := domain.QueryResponse{
+			Status: "success",
+			Data: domain.QueryData{
+				ResultType: "vector",
+				Result: []domain.MetricData{
+					{Metric: map[string]string{"deployment": "microservice-1", "namespace": "default"}, Value: []interface{}{float64(182778586), "2"}},
+					{Metric: map[string]string{"deployment": "microservice-2"}, Value: []interface{}{float64(182778586), "3"}},
+					{Metric: map[string]string{"deployment": "coredns", "namespace": "kube-system"}, Value: []interface{}{float64(182778586), "1"}},
+					{Metric: map[string]string{"deployment": "kube-proxy"}, Value: []interface{}{float64(182778586), "1"}},
+					{Metric: map[string]string{"deployment": "metrics-server", "namespace": "<no value>"}, Value: []interface{}{float64(182778586), "1"}},
+				},
+			},
+		}
+
+		if err := uc.Execute(&response, domain.QueryRequest{Query: "kube_pod_container_resource_requests"}); err != nil {
+			t.Fatal(err)
+		}
+
+		t.Run("then it should render the templates with the series and mapping labels", func(t *testing.T) {
+			expected := []domain.MetricData{
+				{Metric: map[string]string{"deployment": "microservice-1", "namespace": "default", "team": "engineering", "owner": "default/microservice"}, Value: []interface{}{float64(182778586), "2"}},
+				{Metric: map[string]string{"deployment": "microservice-2", "team": "engineering", "owner": "nobody/microservice"}, Value: []interface{}{float64(182778586), "3"}},
+				{Metric: map[string]string{"deployment": "coredns", "namespace": "kube-system", "team": "unowned-kube-system"}, Value: []interface{}{float64(182778586), "1"}},
+				{Metric: map[string]string{"deployment": "kube-proxy", "team": "unowned-"}, Value: []interface{}{float64(182778586), "1"}},
+				{Metric: map[string]string{"deployment": "metrics-server", "namespace": "<no value>", "team": "unowned-<no value>"}, Value: []interface{}{float64(182778586), "1"}},
+			}
+			if !reflect.DeepEqual(response.Data.Result, expected) {
+				t.Fatalf("expected %+v, got %+v", expected, response.Data.Result)
+			}
+		})
+	})
+
+	t.Run("given a query grouped by a label computed from other labels", func(t *testing.T) {
+		query, rewritten := uc.RewriteQuery(domain.QueryRequest{Query: `sum by (team) (kube_pod_container_resource_requests{team="engineering"})`, Mode: domain.EnrichmentModeAggregate})
+
+		t.Run("then it should push down the labels the templates use, leaving the matcher as is", func(t *testing.T) {
+			expected := `sum by (deployment, namespace) (kube_pod_container_resource_requests{team="engineering"})`
+			if !rewritten || query != expected {
+				t.Fatalf("expected %s, got %s", expected, query)
+			}
+		})
+	})
+}
+
+func TestEnrichmentUseCase_Execute_Conditions(t *testing.T) {
+	mappings := func(team string) domain.Mappings {
+		return domain.Mappings{
+			{Pattern: "microservice-.*", SourceData: domain.SourceData{Labels: map[string]string{"team": team}}},
+		}
+	}
+
+	config := &domain.Config{
+		Sources: []domain.Source{
+			{Name: "eu-source", Type: "yaml", Mappings: mappings("engineering-eu")},
+			{Name: "us-source", Type: "yaml", Mappings: mappings("engineering-us")},
+		},
+		Enrichment: domain.Enrichment{
+			Rules: []domain.EnrichmentRule{
+				{
+					Match:      domain.MatchRule{Metric: "kube_pod_container_resource_requests", Label: "deployment"},
+					EnrichFrom: "eu-source",
+					AddLabels:  domain.AddLabels{{Name: "team"}},
+					Mode:       domain.EnrichmentModeKeep,
+					When:       `cluster =~ "eu-.*" and namespace != "kube-system"`,
+				},
+				{
+					Match:      domain.MatchRule{Metric: "kube_pod_container_resource_requests", Label: "deployment"},
+					EnrichFrom: "us-source",
+					AddLabels:  domain.AddLabels{{Name: "team"}},
+					Mode:       domain.EnrichmentModeKeep,
+					When:       `cluster in ["us-1", "us-2"] and namespace != "kube-system"`,
+				},
+			},
+		},
+	}
+
+	uc, err := NewEnrichmentUseCase(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("given series from different clusters and namespaces", func(t *testing.T) {
+		response := domain.QueryResponse{
+			Status: "success",
+			Data: domain.QueryData{
+				ResultType: "vector",
+				Result: []domain.MetricData{
+					{Metric: map[string]string{"deployment": "microservice-1", "cluster": "eu-1", "namespace": "default"}, Value: []interface{}{float64(182778586), "1"}},
+					{Metric: map[string]string{"deployment": "microservice-1", "cluster": "us-2", "namespace": "default"}, Value: []interface{}{float64(182778586), "2"}},
+					{Metric: map[string]string{"deployment": "microservice-1", "cluster": "eu-1", "namespace": "kube-system"}, Value: []interface{}{float64(182778586), "3"}},
+				},
+			},
+		}
+
+		if err := uc.Execute(&response, domain.QueryRequest{Query: "kube_pod_container_resource_requests"}); err != nil {
+			t.Fatal(err)
+		}
+
+		t.Run("then it should only apply the rules whose condition holds", func(t *testing.T) {
+			expected := []domain.MetricData{
+				{Metric: map[string]string{"deployment": "microservice-1", "cluster": "eu-1", "namespace": "default", "team": "engineering-eu"}, Value: []interface{}{float64(182778586), "1"}},
+				{Metric: map[string]string{"deployment": "microservice-1", "cluster": "us-2", "namespace": "default", "team": "engineering-us"}, Value: []interface{}{float64(182778586), "2"}},
+				{Metric: map[string]string{"deployment": "microservice-1", "cluster": "eu-1", "namespace": "kube-system"}, Value: []interface{}{float64(182778586), "3"}},
+			}
+			if !reflect.DeepEqual(response.Data.Result, expected) {
+				t.Fatalf("expected %+v, got %+v", expected, response.Data.Result)
+			}
+		})
+	})
+
+	t.Run("given a query grouped by a label of conditional rules", func(t *testing.T) {
+		query, _ := uc.RewriteQuery(domain.QueryRequest{Query: `sum by (team) (kube_pod_container_resource_requests)`, Mode: domain.EnrichmentModeAggregate})
+
+		t.Run("then it should push down the labels the conditions depend on", func(t *testing.T) {
+			expected := `sum by (deployment, cluster, namespace) (kube_pod_container_resource_requests)`
+			if query != expected {
+				t.Fatalf("expected %s, got %s", expected, query)
+			}
+		})
+	})
+}
+
+func TestEnrichmentUseCase_Execute_RelabelConfigs(t *testing.T) {
+	var rule domain.EnrichmentRule
+	err := yaml.Unmarshal([]byte(`
+match:
+  metric: kube_pod_container_resource_requests
+  label: deployment
+enrich_from: just-a-random-source
+add_labels:
+  - team
+mode: keep
+relabel_configs:
+  - source_labels: [namespace]
+    regex: kube-.*
+    action: drop
+  - source_labels: [team, deployment]
+    regex: (.+);(.+)-[0-9]+
+    target_label: service
+    replacement: $1/$2
+  - regex: pod
+    action: labeldrop
+`), &rule)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &domain.Config{
+		Sources: []domain.Source{
+			{
+				Name: "just-a-random-source",
+				Type: "yaml",
+				Mappings: domain.Mappings{
+					{Pattern: "microservice-.*", SourceData: domain.SourceData{Labels: map[string]string{"team": "engineering"}}},
+				},
+			},
+		},
+		Enrichment: domain.Enrichment{Rules: []domain.EnrichmentRule{rule}},
+	}
+
+	uc, err := NewEnrichmentUseCase(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("given series enriched by a rule with relabel steps", func(t *testing.T) {
+		response := domain.QueryResponse{
+			Status: "success",
+			Data: domain.QueryData{
+				ResultType: "vector",
+				Result: []domain.MetricData{
+					{Metric: map[string]string{"deployment": "microservice-1", "namespace": "default", "pod": "microservice-1-abc"}, Value: []interface{}{float64(182778586), "2"}},
+					{Metric: map[string]string{"deployment": "coredns", "namespace": "kube-system", "pod": "coredns-def"}, Value: []interface{}{float64(182778586), "1"}},
+					{Metric: map[string]string{"deployment": "grafana", "namespace": "monitoring", "pod": "grafana-ghi"}, Value: []interface{}{float64(182778586), "3"}},
+				},
+			},
+		}
+
+		if err := uc.Execute(&response, domain.QueryRequest{Query: "kube_pod_container_resource_requests"}); err != nil {
+			t.Fatal(err)
+		}
+
+		t.Run("then it should relabel them after enriching them", func(t *testing.T) {
+			expected := []domain.MetricData{
+				{Metric: map[string]string{"deployment": "microservice-1", "namespace": "default", "team": "engineering", "service": "engineering/microservice"}, Value: []interface{}{float64(182778586), "2"}},
+				{Metric: map[string]string{"deployment": "grafana", "namespace": "monitoring"}, Value: []interface{}{float64(182778586), "3"}},
+			}
+			if !reflect.DeepEqual(response.Data.Result, expected) {
+				t.Fatalf("expected %+v, got %+v", expected, response.Data.Result)
+			}
+		})
+	})
+}
+
+func TestEnrichmentUseCase_Execute_CandidateLabels(t *testing.T) {
+	config := &domain.Config{
+		Sources: []domain.Source{
+			{
+				Name: "workloads",
+				Type: "yaml",
+				Mappings: domain.Mappings{
+					{Pattern: "microservice-.*", SourceData: domain.SourceData{Labels: map[string]string{"team": "engineering"}}},
+					{Pattern: "postgres", SourceData: domain.SourceData{Labels: map[string]string{"team": "databases"}}},
+				},
+			},
+			{
+				Name: "namespaces",
+				Type: "yaml",
+				Mappings: domain.Mappings{
+					{Pattern: "monitoring", SourceData: domain.SourceData{Labels: map[string]string{"team": "observability"}}},
+				},
+			},
+		},
+		Enrichment: domain.Enrichment{
+			Rules: []domain.EnrichmentRule{
+				{
+					Match: domain.MatchRule{
+						Metric: "container_memory_working_set_bytes",
+						Labels: domain.MatchLabels{
+							{Label: "deployment"},
+							{Label: "statefulset"},
+							{Label: "namespace", EnrichFrom: "namespaces"},
+						},
+					},
+					EnrichFrom: "workloads",
+					AddLabels:  domain.AddLabels{{Name: "team"}},
+					Fallback:   map[string]string{"team": "unknown"},
+					Mode:       domain.EnrichmentModeKeep,
+				},
+			},
+		},
+	}
+
+	uc, err := NewEnrichmentUseCase(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("given series identified by different labels", func(t *testing.T) {
+		response := domain.QueryResponse{
+			Status: "success",
+			Data: domain.QueryData{
+				ResultType: "vector",
+				Result: []domain.MetricData{
+					{Metric: map[string]string{"deployment": "microservice-1", "namespace": "default"}, Value: []interface{}{float64(182778586), "1"}},
+					{Metric: map[string]string{"statefulset": "postgres", "namespace": "default"}, Value: []interface{}{float64(182778586), "2"}},
+					{Metric: map[string]string{"deployment": "grafana", "namespace": "monitoring"}, Value: []interface{}{float64(182778586), "3"}},
+					{Metric: map[string]string{"daemonset": "node-exporter", "namespace": "kube-system"}, Value: []interface{}{float64(182778586), "4"}},
+					{Metric: map[string]string{"job": "kubelet"}, Value: []interface{}{float64(182778586), "5"}},
+				},
+			},
+		}
+
+		if err := uc.Execute(&response, domain.QueryRequest{Query: "container_memory_working_set_bytes"}); err != nil {
+			t.Fatal(err)
+		}
+
+		t.Run("then it should enrich them from the first label found in a mapping", func(t *testing.T) {
+			expected := []domain.MetricData{
+				{Metric: map[string]string{"deployment": "microservice-1", "namespace": "default", "team": "engineering"}, Value: []interface{}{float64(182778586), "1"}},
+				{Metric: map[string]string{"statefulset": "postgres", "namespace": "default", "team": "databases"}, Value: []interface{}{float64(182778586), "2"}},
+				{Metric: map[string]string{"deployment": "grafana", "namespace": "monitoring", "team": "observability"}, Value: []interface{}{float64(182778586), "3"}},
+				{Metric: map[string]string{"daemonset": "node-exporter", "namespace": "kube-system", "team": "unknown"}, Value: []interface{}{float64(182778586), "4"}},
+				{Metric: map[string]string{"job": "kubelet"}, Value: []interface{}{float64(182778586), "5"}},
+			}
+			if !reflect.DeepEqual(response.Data.Result, expected) {
+				t.Fatalf("expected %+v, got %+v", expected, response.Data.Result)
+			}
+		})
+	})
+
+	t.Run("given a query grouped by the enriched label", func(t *testing.T) {
+		query, _ := uc.RewriteQuery(domain.QueryRequest{Query: `sum by (team) (container_memory_working_set_bytes{team="engineering"})`, Mode: domain.EnrichmentModeAggregate})
+
+		t.Run("then it should push down every candidate label, leaving the matcher as is", func(t *testing.T) {
+			expected := `sum by (deployment, statefulset, namespace) (container_memory_working_set_bytes{team="engineering"})`
+			if query != expected {
+				t.Fatalf("expected %s, got %s", expected, query)
+			}
+		})
+	})
+}
+
+func TestEnrichmentUseCase_Execute_WorkloadExtraction(t *testing.T) {
+	config := &domain.Config{
+		Sources: []domain.Source{
+			{
+				Name:      "workloads",
+				Type:      "yaml",
+				MatchMode: domain.MatchModeFull,
+				Mappings: domain.Mappings{
+					{Pattern: "checkout", SourceData: domain.SourceData{Labels: map[string]string{"team": "payments"}}},
+					{Pattern: "postgres", SourceData: domain.SourceData{Labels: map[string]string{"team": "databases"}}},
+				},
+			},
+		},
+		Enrichment: domain.Enrichment{
+			Rules: []domain.EnrichmentRule{
+				{
+					Match:      domain.MatchRule{Metric: "container_cpu_usage_seconds_total", Label: "pod", Extract: domain.KeyExtractorWorkload},
+					EnrichFrom: "workloads",
+					AddLabels:  domain.AddLabels{{Name: "team"}},
+				},
+			},
+		},
+	}
+
+	uc, err := NewEnrichmentUseCase(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("given series only carrying the pod name", func(t *testing.T) {
+		response := domain.QueryResponse{
+			Status: "success",
+			Data: domain.QueryData{
+				ResultType: "vector",
+				Result: []domain.MetricData{
+					{Metric: map[string]string{"pod": "checkout-7d9f8c6b5-x2k9q"}, Value: []interface{}{float64(182778586), "1"}},
+					{Metric: map[string]string{"pod": "checkout-7d9f8c6b5-p4n7z"}, Value: []interface{}{float64(182778586), "2"}},
+					{Metric: map[string]string{"pod": "postgres-0"}, Value: []interface{}{float64(182778586), "4"}},
+				},
+			},
+		}
+
+		if err := uc.Execute(&response, domain.QueryRequest{Query: "sum(rate(container_cpu_usage_seconds_total[5m])) by (pod)"}); err != nil {
+			t.Fatal(err)
+		}
+
+		t.Run("then it should look up the owning workload", func(t *testing.T) {
+			expected := []domain.MetricData{
+				{Metric: map[string]string{"team": "payments"}, Value: []interface{}{float64(182778586), "3"}},
+				{Metric: map[string]string{"team": "databases"}, Value: []interface{}{float64(182778586), "4"}},
+			}
+			if !reflect.DeepEqual(response.Data.Result, expected) {
+				t.Fatalf("expected %+v, got %+v", expected, response.Data.Result)
+			}
+		})
+	})
+}
+
+func TestEnrichmentUseCase_Execute_FanOut(t *testing.T) {
+	config := &domain.Config{
+		Sources: []domain.Source{
+			{
+				Name: "just-a-random-source",
+				Type: "yaml",
+				Mappings: domain.Mappings{
+					{Pattern: "checkout", SourceData: domain.SourceData{Labels: map[string]string{"team": "payments"}}},
+					{
+						Pattern: "ingress-nginx",
+						SourceData: domain.SourceData{
+							Labels: map[string]string{"tier": "shared"},
+							Targets: []domain.Target{
+								{Labels: map[string]string{"team": "payments"}},
+								{Labels: map[string]string{"team": "search"}},
+							},
+						},
+					},
+				},
+			},
+		},
+		Enrichment: domain.Enrichment{
+			Rules: []domain.EnrichmentRule{
+				{
+					Match:      domain.MatchRule{Metric: "kube_deployment_spec_replicas", Label: "deployment"},
+					EnrichFrom: "just-a-random-source",
+					AddLabels:  domain.AddLabels{{Name: "team"}},
+				},
+			},
+		},
+	}
+
+	uc, err := NewEnrichmentUseCase(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("given a series matching a mapping with several targets", func(t *testing.T) {
+		response := domain.QueryResponse{
+			Status: "success",
+			Data: domain.QueryData{
+				ResultType: "vector",
+				Result: []domain.MetricData{
+					{Metric: map[string]string{"deployment": "checkout"}, Value: []interface{}{float64(182778586), "2"}},
+					{Metric: map[string]string{"deployment": "ingress-nginx"}, Value: []interface{}{float64(182778586), "3"}},
+				},
+			},
+		}
+
+		if err := uc.Execute(&response, domain.QueryRequest{Query: "sum(kube_deployment_spec_replicas) by (team)"}); err != nil {
+			t.Fatal(err)
+		}
+
+		t.Run("then it should count the series in each of them", func(t *testing.T) {
+			expected := []domain.MetricData{
+				{Metric: map[string]string{"team": "payments"}, Value: []interface{}{float64(182778586), "5"}},
+				{Metric: map[string]string{"team": "search"}, Value: []interface{}{float64(182778586), "3"}},
+			}
+			if !reflect.DeepEqual(response.Data.Result, expected) {
+				t.Fatalf("expected %+v, got %+v", expected, response.Data.Result)
+			}
+		})
+	})
+
+	t.Run("given a filter on a label of one of the targets", func(t *testing.T) {
+		query, _ := uc.RewriteQuery(domain.QueryRequest{Query: `kube_deployment_spec_replicas{team="search"}`})
+
+		t.Run("then it should select the series of the mapping", func(t *testing.T) {
+			expected := `kube_deployment_spec_replicas{deployment!="",deployment!~".*(?:checkout).*",deployment=~".*(?:ingress-nginx).*"}`
+			if query != expected {
+				t.Fatalf("expected %s, got %s", expected, query)
+			}
+		})
+	})
+}
+
+func TestEnrichmentUseCase_Execute_WeightedTargets(t *testing.T) {
+	weight := func(w float64) *float64 { return &w }
+
+	config := &domain.Config{
+		Sources: []domain.Source{
+			{
+				Name:        "just-a-random-source",
+				Type:        "yaml",
+				WeightsFrom: "ratios",
+				Mappings: domain.Mappings{
+					{
+						Pattern: "ingress-nginx",
+						SourceData: domain.SourceData{
+							Targets: []domain.Target{
+								{Labels: map[string]string{"team": "payments"}, Weight: weight(0.6)},
+								{Labels: map[string]string{"team": "search"}, Weight: weight(0.4)},
+							},
+						},
+					},
+					{
+						Pattern: "postgres",
+						SourceData: domain.SourceData{
+							Targets: []domain.Target{
+								{Labels: map[string]string{"team": "payments"}},
+								{Labels: map[string]string{"team": "search"}},
+							},
+						},
+					},
+				},
+			},
+			{
+				Name: "ratios",
+				Type: "yaml",
+				Mappings: domain.Mappings{
+					{
+						Pattern: "postgres",
+						SourceData: domain.SourceData{
+							Targets: []domain.Target{
+								{Labels: map[string]string{"team": "search"}, Weight: weight(0.75)},
+								{Labels: map[string]string{"team": "payments"}, Weight: weight(0.25)},
+							},
+						},
+					},
+				},
+			},
+		},
+		Enrichment: domain.Enrichment{
+			Rules: []domain.EnrichmentRule{
+				{
+					Match:      domain.MatchRule{Metric: "container_cpu_usage_seconds_total", Label: "deployment"},
+					EnrichFrom: "just-a-random-source",
+					AddLabels:  domain.AddLabels{{Name: "team"}},
+				},
+			},
+		},
+	}
+
+	uc, err := NewEnrichmentUseCase(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("given a range vector of shared deployments", func(t *testing.T) {
+		response := domain.QueryResponse{
+			Status: "success",
+			Data: domain.QueryData{
+				ResultType: "matrix",
+				Result: []domain.MetricData{
+					{Metric: map[string]string{"deployment": "ingress-nginx"}, Values: [][]interface{}{{float64(182778586), "10"}, {float64(182778646), "20"}}},
+					{Metric: map[string]string{"deployment": "postgres"}, Values: [][]interface{}{{float64(182778586), "4"}, {float64(182778646), "8"}}},
+				},
+			},
+		}
+
+		query := "sum(rate(container_cpu_usage_seconds_total[5m])) by (team)"
+		if err := uc.Execute(&response, domain.QueryRequest{Query: query, Range: true}); err != nil {
+			t.Fatal(err)
+		}
+
+		t.Run("then it should split their values according to the weights", func(t *testing.T) {
+			expected := []domain.MetricData{
+				{Metric: map[string]string{"team": "payments"}, Values: [][]interface{}{{float64(182778586), "7"}, {float64(182778646), "14"}}},
+				{Metric: map[string]string{"team": "search"}, Values: [][]interface{}{{float64(182778586), "7"}, {float64(182778646), "14"}}},
+			}
+			if !reflect.DeepEqual(response.Data.Result, expected) {
+				t.Fatalf("expected %+v, got %+v", expected, response.Data.Result)
+			}
+		})
+	})
+
+	instantVector := func() domain.QueryResponse {
+		return domain.QueryResponse{
+			Status: "success",
+			Data: domain.QueryData{
+				ResultType: "vector",
+				Result: []domain.MetricData{
+					{Metric: map[string]string{"deployment": "ingress-nginx"}, Value: []interface{}{float64(182778586), "10"}},
+					{Metric: map[string]string{"deployment": "postgres"}, Value: []interface{}{float64(182778586), "4"}},
+				},
+			},
+		}
+	}
+	ignoredWarnings := []string{"target weights were ignored, since the enriched series are not merged by summing them"}
+
+	t.Run("given a max of shared deployments", func(t *testing.T) {
+		response := instantVector()
+
+		query := "max(container_cpu_usage_seconds_total) by (team)"
+		if err := uc.Execute(&response, domain.QueryRequest{Query: query}); err != nil {
+			t.Fatal(err)
+		}
+
+		t.Run("then it should ignore the weights, with a warning", func(t *testing.T) {
+			expected := []domain.MetricData{
+				{Metric: map[string]string{"team": "payments"}, Value: []interface{}{float64(182778586), "10"}},
+				{Metric: map[string]string{"team": "search"}, Value: []interface{}{float64(182778586), "10"}},
+			}
+			if !reflect.DeepEqual(response.Data.Result, expected) {
+				t.Fatalf("expected %+v, got %+v", expected, response.Data.Result)
+			}
+			if !reflect.DeepEqual(response.Warnings, ignoredWarnings) {
+				t.Fatalf("expected warnings %v, got %v", ignoredWarnings, response.Warnings)
+			}
+		})
+	})
+
+	t.Run("given a count of shared deployments", func(t *testing.T) {
+		response := instantVector()
+		for i := range response.Data.Result {
+			response.Data.Result[i].Value = []interface{}{float64(182778586), "1"}
+		}
+
+		query := "count(container_cpu_usage_seconds_total) by (team)"
+		if err := uc.Execute(&response, domain.QueryRequest{Query: query}); err != nil {
+			t.Fatal(err)
+		}
+
+		t.Run("then it should count every deployment once per target, with a warning", func(t *testing.T) {
+			expected := []domain.MetricData{
+				{Metric: map[string]string{"team": "payments"}, Value: []interface{}{float64(182778586), "2"}},
+				{Metric: map[string]string{"team": "search"}, Value: []interface{}{float64(182778586), "2"}},
+			}
+			if !reflect.DeepEqual(response.Data.Result, expected) {
+				t.Fatalf("expected %+v, got %+v", expected, response.Data.Result)
+			}
+			if !reflect.DeepEqual(response.Warnings, ignoredWarnings) {
+				t.Fatalf("expected warnings %v, got %v", ignoredWarnings, response.Warnings)
+			}
+		})
+	})
+
+	t.Run("given shared deployments in keep mode", func(t *testing.T) {
+		response := instantVector()
+
+		query := "container_cpu_usage_seconds_total"
+		if err := uc.Execute(&response, domain.QueryRequest{Query: query, Mode: domain.EnrichmentModeKeep}); err != nil {
+			t.Fatal(err)
+		}
+
+		t.Run("then it should keep their values as they are, with a warning", func(t *testing.T) {
+			expected := []domain.MetricData{
+				{Metric: map[string]string{"deployment": "ingress-nginx", "team": "payments"}, Value: []interface{}{float64(182778586), "10"}},
+				{Metric: map[string]string{"deployment": "ingress-nginx", "team": "search"}, Value: []interface{}{float64(182778586), "10"}},
+				{Metric: map[string]string{"deployment": "postgres", "team": "payments"}, Value: []interface{}{float64(182778586), "4"}},
+				{Metric: map[string]string{"deployment": "postgres", "team": "search"}, Value: []interface{}{float64(182778586), "4"}},
+			}
+			if !reflect.DeepEqual(response.Data.Result, expected) {
+				t.Fatalf("expected %+v, got %+v", expected, response.Data.Result)
+			}
+			if !reflect.DeepEqual(response.Warnings, ignoredWarnings) {
+				t.Fatalf("expected warnings %v, got %v", ignoredWarnings, response.Warnings)
+			}
+		})
+	})
+}
+
+func TestEnrichmentUseCase_Execute_Filters(t *testing.T) {
+	config := &domain.Config{
+		Sources: []domain.Source{
+			{
+				Name: "just-a-random-source",
+				Type: "yaml",
+				Mappings: domain.Mappings{
+					{Pattern: "prometheus-grafana", SourceData: domain.SourceData{Labels: map[string]string{"team": "dashboards"}}},
+					{Pattern: "prometheus-.*", SourceData: domain.SourceData{Labels: map[string]string{"team": "observability"}}},
+					{
+						Pattern: "ingress-nginx",
+						SourceData: domain.SourceData{
+							Targets: []domain.Target{
+								{Labels: map[string]string{"team": "payments"}},
+								{Labels: map[string]string{"team": "search"}},
+							},
+						},
+					},
+				},
+			},
+		},
+		Enrichment: domain.Enrichment{
+			Rules: []domain.EnrichmentRule{
+				{
+					Match:      domain.MatchRule{Metric: "kube_deployment_spec_replicas", Label: "deployment"},
+					EnrichFrom: "just-a-random-source",
+					AddLabels:  domain.AddLabels{{Name: "team"}},
+					Fallback:   map[string]string{"team": "unknown"},
+				},
+			},
+		},
+	}
+
+	uc, err := NewEnrichmentUseCase(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	createResponse := func() domain.QueryResponse {
+		return domain.QueryResponse{
+			Status: "success",
+			Data: domain.QueryData{
+				ResultType: "vector",
+				Result: []domain.MetricData{
+					{Metric: map[string]string{"deployment": "prometheus-grafana"}, Value: []interface{}{float64(182778586), "1"}},
+					{Metric: map[string]string{"deployment": "prometheus-server"}, Value: []interface{}{float64(182778586), "2"}},
+					{Metric: map[string]string{"deployment": "ingress-nginx"}, Value: []interface{}{float64(182778586), "3"}},
+					{Metric: map[string]string{"deployment": "coredns"}, Value: []interface{}{float64(182778586), "4"}},
+				},
+			},
+		}
+	}
+
+	testCases := []struct {
+		name     string
+		query    string
+		expected []domain.MetricData
+	}{
+		{
+			name:  "a filter on a value of a lower ranked mapping",
+			query: `sum(kube_deployment_spec_replicas{team="observability"}) by (team)`,
+			expected: []domain.MetricData{
+				{Metric: map[string]string{"team": "observability"}, Value: []interface{}{float64(182778586), "2"}},
+			},
+		},
+		{
+			name:  "a filter on a label of one of the targets",
+			query: `sum(kube_deployment_spec_replicas{team="search"}) by (team)`,
+			expected: []domain.MetricData{
+				{Metric: map[string]string{"team": "search"}, Value: []interface{}{float64(182778586), "3"}},
+			},
+		},
+		{
+			name:  "a filter satisfied by the fallback value",
+			query: `sum(kube_deployment_spec_replicas{team=~"unknown|payments"}) by (team)`,
+			expected: []domain.MetricData{
+				{Metric: map[string]string{"team": "payments"}, Value: []interface{}{float64(182778586), "3"}},
+				{Metric: map[string]string{"team": "unknown"}, Value: []interface{}{float64(182778586), "4"}},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run("given "+tc.name, func(t *testing.T) {
+			response := createResponse()
+			if err := uc.Execute(&response, domain.QueryRequest{Query: tc.query}); err != nil {
+				t.Fatal(err)
+			}
+
+			t.Run("then it should only return the series satisfying it once enriched", func(t *testing.T) {
+				if !reflect.DeepEqual(response.Data.Result, tc.expected) {
+					t.Fatalf("expected %+v, got %+v", tc.expected, response.Data.Result)
+				}
+			})
+		})
+	}
+}
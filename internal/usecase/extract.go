@@ -0,0 +1,49 @@
+package usecase
+
+import (
+	"regexp"
+
+	"github.com/lucianocarvalho/labelify/internal/domain"
+)
+
+// Alphabet of the random suffixes Kubernetes generates.
+const safeAlphabet = `[bcdfghjklmnpqrstvwxz2456789]`
+
+var (
+	podSuffix         = regexp.MustCompile(`^(.+)-` + safeAlphabet + `{5}$`)
+	replicaSetSuffix  = regexp.MustCompile(`^(.+)-` + safeAlphabet + `{6,10}$`)
+	cronJobSuffix     = regexp.MustCompile(`^(.+)-[0-9]{8,}$`)
+	statefulSetSuffix = regexp.MustCompile(`^(.+)-[0-9]+$`)
+)
+
+func extractKey(extractor domain.KeyExtractor, value string) string {
+	switch extractor {
+	case domain.KeyExtractorWorkload:
+		return workloadName(value)
+	default:
+		return value
+	}
+}
+
+// workloadName strips the suffixes Kubernetes appends to the names of the
+// pods it creates, eg: checkout-7d9f8c6b5-x2k9q -> checkout.
+func workloadName(name string) string {
+	if match := podSuffix.FindStringSubmatch(name); match != nil {
+		owner := match[1]
+		if match := replicaSetSuffix.FindStringSubmatch(owner); match != nil {
+			return match[1]
+		}
+		if match := cronJobSuffix.FindStringSubmatch(owner); match != nil {
+			return match[1]
+		}
+		return owner
+	}
+
+	if match := statefulSetSuffix.FindStringSubmatch(name); match != nil {
+		return match[1]
+	}
+	if match := replicaSetSuffix.FindStringSubmatch(name); match != nil {
+		return match[1]
+	}
+	return name
+}
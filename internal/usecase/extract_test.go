@@ -0,0 +1,36 @@
+package usecase
+
+import (
+	"testing"
+
+	"github.com/lucianocarvalho/labelify/internal/domain"
+)
+
+func TestExtractKey_Workload(t *testing.T) {
+	testCases := []struct {
+		value    string
+		expected string
+	}{
+		{value: "checkout-7d9f8c6b5-x2k9q", expected: "checkout"},
+		{value: "payments-api-5b6c7d8f9g-4xk2p", expected: "payments-api"},
+		{value: "checkout-7d9f8c6b5", expected: "checkout"},
+		{value: "node-exporter-x2k9q", expected: "node-exporter"},
+		{value: "backup-28413560-x2k9q", expected: "backup"},
+		{value: "postgres-0", expected: "postgres"},
+		{value: "kafka-broker-12", expected: "kafka-broker"},
+		{value: "coredns", expected: "coredns"},
+		{value: "prometheus-server", expected: "prometheus-server"},
+	}
+
+	for _, tc := range testCases {
+		t.Run("given the pod "+tc.value, func(t *testing.T) {
+			key := extractKey(domain.KeyExtractorWorkload, tc.value)
+
+			t.Run("then it should return the owning workload name", func(t *testing.T) {
+				if key != tc.expected {
+					t.Fatalf("expected %q, got %q", tc.expected, key)
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,338 @@
+package usecase
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Boundary rule of the zero bucket (closed on both sides), as returned by
+// the Prometheus HTTP API.
+const boundaryClosed = 3
+
+var errIncompatibleHistograms = errors.New("native histograms with incompatible bucket layouts")
+
+type histogramBucket struct {
+	boundaries int
+	lower      float64
+	upper      float64
+	count      float64
+}
+
+type histogram struct {
+	count   float64
+	sum     float64
+	buckets []histogramBucket
+}
+
+func parseHistogram(value interface{}) (*histogram, error) {
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid histogram: %v", value)
+	}
+
+	count, err := parseSampleValue(object["count"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid histogram count: %w", err)
+	}
+
+	sum, err := parseSampleValue(object["sum"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid histogram sum: %w", err)
+	}
+
+	h := &histogram{count: count, sum: sum}
+
+	buckets, _ := object["buckets"].([]interface{})
+	for _, b := range buckets {
+		fields, ok := b.([]interface{})
+		if !ok || len(fields) != 4 {
+			return nil, fmt.Errorf("invalid histogram bucket: %v", b)
+		}
+
+		boundaries, ok := fields[0].(float64)
+		if !ok {
+			return nil, fmt.Errorf("invalid histogram bucket boundaries: %v", fields[0])
+		}
+
+		var bucket histogramBucket
+		bucket.boundaries = int(boundaries)
+		if bucket.lower, err = parseSampleValue(fields[1]); err != nil {
+			return nil, fmt.Errorf("invalid histogram bucket lower bound: %w", err)
+		}
+		if bucket.upper, err = parseSampleValue(fields[2]); err != nil {
+			return nil, fmt.Errorf("invalid histogram bucket upper bound: %w", err)
+		}
+		if bucket.count, err = parseSampleValue(fields[3]); err != nil {
+			return nil, fmt.Errorf("invalid histogram bucket count: %w", err)
+		}
+
+		h.buckets = append(h.buckets, bucket)
+	}
+
+	return h, nil
+}
+
+func (h *histogram) format() map[string]interface{} {
+	object := map[string]interface{}{
+		"count": formatSampleValue(h.count),
+		"sum":   formatSampleValue(h.sum),
+	}
+
+	if len(h.buckets) > 0 {
+		buckets := make([]interface{}, 0, len(h.buckets))
+		for _, b := range h.buckets {
+			buckets = append(buckets, []interface{}{
+				b.boundaries,
+				formatSampleValue(b.lower),
+				formatSampleValue(b.upper),
+				formatSampleValue(b.count),
+			})
+		}
+		object["buckets"] = buckets
+	}
+
+	return object
+}
+
+func (h *histogram) clone() *histogram {
+	c := *h
+	c.buckets = append([]histogramBucket(nil), h.buckets...)
+	return &c
+}
+
+// add merges other into h. Buckets with the same boundaries are summed. When
+// the layouts overlap, both histograms are first brought to the same
+// (coarser) schema and zero bucket width.
+func (h *histogram) add(other *histogram) error {
+	a, b := h.clone(), other.clone()
+
+	if !compatibleBuckets(a.buckets, b.buckets) {
+		if err := reconcileHistograms(a, b); err != nil {
+			return err
+		}
+	}
+
+	for _, bucket := range b.buckets {
+		merged := false
+		for i := range a.buckets {
+			if sameBucket(a.buckets[i], bucket) {
+				a.buckets[i].count += bucket.count
+				merged = true
+				break
+			}
+		}
+		if !merged {
+			a.buckets = append(a.buckets, bucket)
+		}
+	}
+
+	sortBuckets(a.buckets)
+
+	h.count = a.count + b.count
+	h.sum = a.sum + b.sum
+	h.buckets = a.buckets
+
+	return nil
+}
+
+func (h *histogram) scale(factor float64) {
+	h.count *= factor
+	h.sum *= factor
+	for i := range h.buckets {
+		h.buckets[i].count *= factor
+	}
+}
+
+func reconcileHistograms(a, b *histogram) error {
+	schemaA, knownA, err := a.schema()
+	if err != nil {
+		return err
+	}
+
+	schemaB, knownB, err := b.schema()
+	if err != nil {
+		return err
+	}
+
+	if knownA && knownB {
+		if schemaA > schemaB {
+			a.reduceSchema(schemaA, schemaB)
+		} else if schemaB > schemaA {
+			b.reduceSchema(schemaB, schemaA)
+		}
+	}
+
+	threshold := math.Max(a.zeroThreshold(), b.zeroThreshold())
+	if threshold > 0 {
+		if err := a.widenZeroBucket(threshold); err != nil {
+			return err
+		}
+		if err := b.widenZeroBucket(threshold); err != nil {
+			return err
+		}
+	}
+
+	if !compatibleBuckets(a.buckets, b.buckets) {
+		return errIncompatibleHistograms
+	}
+
+	return nil
+}
+
+// schema infers the exponential schema from the regular buckets bounds,
+// where every bucket spans a factor of 2^(2^-schema).
+func (h *histogram) schema() (int, bool, error) {
+	schema, known := 0, false
+
+	for _, bucket := range h.buckets {
+		if isZeroBucket(bucket) {
+			continue
+		}
+
+		var ratio float64
+		switch {
+		case bucket.lower > 0:
+			ratio = bucket.upper / bucket.lower
+		case bucket.upper < 0:
+			ratio = bucket.lower / bucket.upper
+		default:
+			return 0, false, errIncompatibleHistograms
+		}
+
+		exact := -math.Log2(math.Log2(ratio))
+		rounded := math.Round(exact)
+		if math.IsNaN(exact) || math.Abs(exact-rounded) > 1e-6 || rounded < -4 || rounded > 8 {
+			// Custom bucket boundaries can only be merged when identical.
+			return 0, false, errIncompatibleHistograms
+		}
+
+		if known && int(rounded) != schema {
+			return 0, false, errIncompatibleHistograms
+		}
+		schema, known = int(rounded), true
+	}
+
+	return schema, known, nil
+}
+
+func (h *histogram) reduceSchema(from, to int) {
+	delta := uint(from - to)
+	reduced := make([]histogramBucket, 0, len(h.buckets))
+
+	for _, bucket := range h.buckets {
+		if isZeroBucket(bucket) {
+			reduced = append(reduced, bucket)
+			continue
+		}
+
+		upper := bucket.upper
+		if bucket.upper < 0 {
+			upper = -bucket.lower
+		}
+
+		index := int(math.Round(math.Log2(upper) * math.Exp2(float64(from))))
+		target := ((index - 1) >> delta) + 1
+
+		lower := math.Exp2(float64(target-1) * math.Exp2(-float64(to)))
+		upper = math.Exp2(float64(target) * math.Exp2(-float64(to)))
+
+		if bucket.upper < 0 {
+			bucket.lower, bucket.upper = -upper, -lower
+		} else {
+			bucket.lower, bucket.upper = lower, upper
+		}
+
+		merged := false
+		for i := range reduced {
+			if sameBucket(reduced[i], bucket) {
+				reduced[i].count += bucket.count
+				merged = true
+				break
+			}
+		}
+		if !merged {
+			reduced = append(reduced, bucket)
+		}
+	}
+
+	sortBuckets(reduced)
+	h.buckets = reduced
+}
+
+func (h *histogram) zeroThreshold() float64 {
+	for _, bucket := range h.buckets {
+		if isZeroBucket(bucket) {
+			return bucket.upper
+		}
+	}
+	return 0
+}
+
+func (h *histogram) widenZeroBucket(threshold float64) error {
+	zero := histogramBucket{boundaries: boundaryClosed, lower: -threshold, upper: threshold}
+	buckets := make([]histogramBucket, 0, len(h.buckets)+1)
+
+	for _, bucket := range h.buckets {
+		switch {
+		case isZeroBucket(bucket):
+			zero.count += bucket.count
+		case bucket.lower >= -threshold && bucket.upper <= threshold:
+			zero.count += bucket.count
+		case bucket.lower < threshold && bucket.upper > -threshold:
+			// The bucket straddles the new zero bucket.
+			return errIncompatibleHistograms
+		default:
+			buckets = append(buckets, bucket)
+		}
+	}
+
+	if zero.count > 0 || h.zeroThreshold() > 0 {
+		buckets = append(buckets, zero)
+	}
+
+	sortBuckets(buckets)
+	h.buckets = buckets
+
+	return nil
+}
+
+func compatibleBuckets(a, b []histogramBucket) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if sameBucket(x, y) {
+				continue
+			}
+			if x.upper <= y.lower || y.upper <= x.lower {
+				continue
+			}
+			return false
+		}
+	}
+	return true
+}
+
+func sameBucket(a, b histogramBucket) bool {
+	return a.boundaries == b.boundaries && sameBound(a.lower, b.lower) && sameBound(a.upper, b.upper)
+}
+
+func sameBound(a, b float64) bool {
+	if a == b {
+		return true
+	}
+	return math.Abs(a-b) <= 1e-9*math.Max(math.Abs(a), math.Abs(b))
+}
+
+func isZeroBucket(bucket histogramBucket) bool {
+	return bucket.lower <= 0 && bucket.upper >= 0 && sameBound(-bucket.lower, bucket.upper)
+}
+
+func sortBuckets(buckets []histogramBucket) {
+	sort.SliceStable(buckets, func(i, j int) bool {
+		if buckets[i].lower != buckets[j].lower {
+			return buckets[i].lower < buckets[j].lower
+		}
+		return buckets[i].upper < buckets[j].upper
+	})
+}
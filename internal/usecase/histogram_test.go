@@ -0,0 +1,200 @@
+package usecase
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/lucianocarvalho/labelify/internal/domain"
+)
+
+func TestEnrichmentUseCase_Execute_NativeHistograms(t *testing.T) {
+	query := "sum(rate(http_request_duration_seconds[5m])) by (deployment)"
+
+	config := &domain.Config{
+		Sources: []domain.Source{
+			{
+				Name: "just-a-random-source",
+				Type: "yaml",
+				Mappings: domain.Mappings{
+					{
+						Pattern: "microservice-.*",
+						SourceData: domain.SourceData{
+							Labels: map[string]string{
+								"team": "engineering",
+							},
+						},
+					},
+				},
+			},
+		},
+		Enrichment: domain.Enrichment{
+			Rules: []domain.EnrichmentRule{
+				{
+					Match:      domain.MatchRule{Metric: "http_request_duration_seconds", Label: "deployment"},
+					EnrichFrom: "just-a-random-source",
+					AddLabels:  domain.AddLabels{{Name: "team"}},
+				},
+			},
+		},
+	}
+
+	createResponse := func(first, second map[string]interface{}) domain.QueryResponse {
+		return domain.QueryResponse{
+			Status: "success",
+			Data: domain.QueryData{
+				ResultType: "vector",
+				Result: []domain.MetricData{
+					{
+						Metric:    map[string]string{"deployment": "microservice-1"},
+						Histogram: []interface{}{float64(182778586), first},
+					},
+					{
+						Metric:    map[string]string{"deployment": "microservice-2"},
+						Histogram: []interface{}{float64(182778586), second},
+					},
+				},
+			},
+		}
+	}
+
+	t.Run("given two histograms with the same schema", func(t *testing.T) {
+		response := createResponse(
+			map[string]interface{}{
+				"count": "4",
+				"sum":   "6.5",
+				"buckets": []interface{}{
+					[]interface{}{float64(0), "1", "2", "3"},
+					[]interface{}{float64(0), "2", "4", "1"},
+				},
+			},
+			map[string]interface{}{
+				"count": "2",
+				"sum":   "9",
+				"buckets": []interface{}{
+					[]interface{}{float64(0), "4", "8", "2"},
+				},
+			},
+		)
+
+		uc, err := NewEnrichmentUseCase(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := uc.Execute(&response, domain.QueryRequest{Query: query}); err != nil {
+			t.Fatal(err)
+		}
+
+		t.Run("then it should add bucket counts, sums and counts", func(t *testing.T) {
+			expected := []domain.MetricData{
+				{
+					Metric: map[string]string{"team": "engineering"},
+					Histogram: []interface{}{float64(182778586), map[string]interface{}{
+						"count": "6",
+						"sum":   "15.5",
+						"buckets": []interface{}{
+							[]interface{}{0, "1", "2", "3"},
+							[]interface{}{0, "2", "4", "1"},
+							[]interface{}{0, "4", "8", "2"},
+						},
+					}},
+				},
+			}
+
+			if !reflect.DeepEqual(response.Data.Result, expected) {
+				t.Fatalf("expected %+v, got %+v", expected, response.Data.Result)
+			}
+		})
+	})
+
+	t.Run("given two histograms with different schemas", func(t *testing.T) {
+		response := createResponse(
+			map[string]interface{}{
+				"count": "4",
+				"sum":   "6",
+				"buckets": []interface{}{
+					[]interface{}{float64(0), "1", "2", "3"},
+					[]interface{}{float64(0), "2", "4", "1"},
+				},
+			},
+			map[string]interface{}{
+				"count": "4",
+				"sum":   "6",
+				"buckets": []interface{}{
+					[]interface{}{float64(0), "1", "1.4142135623730951", "1"},
+					[]interface{}{float64(0), "1.4142135623730951", "2", "2"},
+					[]interface{}{float64(0), "2", "2.8284271247461903", "1"},
+				},
+			},
+		)
+
+		uc, err := NewEnrichmentUseCase(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := uc.Execute(&response, domain.QueryRequest{Query: query}); err != nil {
+			t.Fatal(err)
+		}
+
+		t.Run("then it should merge them using the coarser schema", func(t *testing.T) {
+			expected := []domain.MetricData{
+				{
+					Metric: map[string]string{"team": "engineering"},
+					Histogram: []interface{}{float64(182778586), map[string]interface{}{
+						"count": "8",
+						"sum":   "12",
+						"buckets": []interface{}{
+							[]interface{}{0, "1", "2", "6"},
+							[]interface{}{0, "2", "4", "2"},
+						},
+					}},
+				},
+			}
+
+			if !reflect.DeepEqual(response.Data.Result, expected) {
+				t.Fatalf("expected %+v, got %+v", expected, response.Data.Result)
+			}
+		})
+	})
+
+	t.Run("given two histograms with custom bucket layouts that can't be reconciled", func(t *testing.T) {
+		response := createResponse(
+			map[string]interface{}{
+				"count": "1",
+				"sum":   "1",
+				"buckets": []interface{}{
+					[]interface{}{float64(0), "1", "5", "1"},
+				},
+			},
+			map[string]interface{}{
+				"count": "1",
+				"sum":   "1",
+				"buckets": []interface{}{
+					[]interface{}{float64(0), "1", "10", "1"},
+				},
+			},
+		)
+
+		uc, err := NewEnrichmentUseCase(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := uc.Execute(&response, domain.QueryRequest{Query: query}); err != nil {
+			t.Fatal(err)
+		}
+
+		t.Run("then it should drop the sample", func(t *testing.T) {
+			if len(response.Data.Result) != 0 {
+				t.Fatalf("expected no results, got %+v", response.Data.Result)
+			}
+		})
+
+		t.Run("then it should return a warning", func(t *testing.T) {
+			if len(response.Warnings) != 1 {
+				t.Fatalf("expected 1 warning, got %+v", response.Warnings)
+			}
+		})
+	})
+}
@@ -0,0 +1,442 @@
+package usecase
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"regexp/syntax"
+	"sort"
+	"strings"
+
+	"github.com/lucianocarvalho/labelify/internal/domain"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+type indexedPattern struct {
+	data      *domain.SourceData
+	literal   bool
+	regex     *regexp.Regexp
+	templated bool
+}
+
+type selectorPattern struct {
+	mapping  int
+	matchers []*labels.Matcher
+}
+
+type trieNode struct {
+	children map[byte]*trieNode
+	patterns []int
+}
+
+// mappingIndex finds the mapping of a label value through a hash of the
+// exact keys, a trie of the literals the patterns contain and a single
+// combined regex for the remaining ones. The first matching mapping, in
+// the source precedence order, wins.
+type mappingIndex struct {
+	mappings  domain.Mappings
+	fullMatch bool
+	exact     map[string]int
+	patterns  []indexedPattern
+	trie      *trieNode
+	// Capture group combinedGroups[i] tells whether combinedPatterns[i] matched.
+	combined         *regexp.Regexp
+	combinedPatterns []int
+	combinedGroups   []int
+	selectors        []selectorPattern
+	weightsFrom      string
+}
+
+type cachedIndex struct {
+	revision uint64
+	index    *mappingIndex
+}
+
+func newMappingIndex(mappings domain.Mappings, matchMode domain.MatchMode, precedence domain.Precedence) *mappingIndex {
+	ranked := append(domain.Mappings(nil), mappings...)
+	switch precedence {
+	case domain.PrecedenceLongestLiteral:
+		sort.SliceStable(ranked, func(i, j int) bool {
+			return literalLength(ranked[i].Pattern) > literalLength(ranked[j].Pattern)
+		})
+	case domain.PrecedencePriority:
+		sort.SliceStable(ranked, func(i, j int) bool {
+			return ranked[i].Priority > ranked[j].Priority
+		})
+	}
+
+	idx := &mappingIndex{
+		mappings:  ranked,
+		fullMatch: matchMode == domain.MatchModeFull,
+		exact:     make(map[string]int, len(ranked)),
+		patterns:  make([]indexedPattern, len(ranked)),
+		trie:      &trieNode{},
+	}
+
+	var alternatives []string
+	group := 1
+
+	for i := range ranked {
+		pattern := ranked[i].Pattern
+		idx.patterns[i].data = &ranked[i].SourceData
+		for _, labels := range ranked[i].LabelSets() {
+			idx.patterns[i].templated = idx.patterns[i].templated || hasTemplate(labels)
+		}
+
+		if ranked[i].IsSelector() {
+			matchers, err := parser.ParseMetricSelector(pattern)
+			if err != nil {
+				log.Printf("Error parsing mapping selector %s: %v", pattern, err)
+				continue
+			}
+			idx.selectors = append(idx.selectors, selectorPattern{mapping: i, matchers: matchers})
+			continue
+		}
+
+		regex, err := regexp.Compile(pattern)
+		if err != nil {
+			// Invalid patterns only match themselves.
+			idx.addExact(pattern, i)
+			continue
+		}
+
+		literal, complete := literalPattern(pattern)
+		if complete {
+			idx.addExact(literal, i)
+		}
+		if idx.fullMatch {
+			regex = regexp.MustCompile("^(?:" + pattern + ")$")
+		}
+		idx.patterns[i].literal = complete
+		idx.patterns[i].regex = regex
+
+		if complete && idx.fullMatch {
+			continue
+		}
+
+		if literal := requiredLiteral(pattern); literal != "" {
+			idx.trie.insert(literal, i)
+			continue
+		}
+
+		// With partial matches, the lazy prefix lets the first alternative
+		// matching anywhere in the value be the one picked.
+		if idx.fullMatch {
+			alternatives = append(alternatives, "("+pattern+")")
+		} else {
+			alternatives = append(alternatives, "(?s:.*?)("+pattern+")")
+		}
+		idx.combinedPatterns = append(idx.combinedPatterns, i)
+		idx.combinedGroups = append(idx.combinedGroups, group)
+		group += 1 + regex.NumSubexp()
+	}
+
+	if len(alternatives) > 0 {
+		expr := "^(?:" + strings.Join(alternatives, "|") + ")"
+		if idx.fullMatch {
+			expr += "$"
+		}
+
+		combined, err := regexp.Compile(expr)
+		if err != nil {
+			log.Printf("Error combining mapping patterns: %v", err)
+		}
+		idx.combined = combined
+	}
+
+	return idx
+}
+
+func (idx *mappingIndex) addExact(value string, mapping int) {
+	if _, ok := idx.exact[value]; !ok {
+		idx.exact[value] = mapping
+	}
+}
+
+// literalPattern returns the value a pattern matches, when it only matches
+// a literal (eg: `api\.v1` or `(payments)`).
+func literalPattern(pattern string) (string, bool) {
+	re := parsePattern(pattern)
+	if re == nil || re.Op != syntax.OpLiteral || re.Flags&syntax.FoldCase != 0 {
+		return "", false
+	}
+	return string(re.Rune), true
+}
+
+// requiredLiteral returns the longest literal any value matched by the
+// pattern must contain, if any.
+func requiredLiteral(pattern string) string {
+	re := parsePattern(pattern)
+	if re == nil {
+		return ""
+	}
+
+	literal := func(re *syntax.Regexp) string {
+		if re.Op != syntax.OpLiteral || re.Flags&syntax.FoldCase != 0 {
+			return ""
+		}
+		return string(re.Rune)
+	}
+
+	if re.Op != syntax.OpConcat {
+		return literal(re)
+	}
+
+	longest := ""
+	for _, sub := range re.Sub {
+		if l := literal(sub); len(l) > len(longest) {
+			longest = l
+		}
+	}
+	return longest
+}
+
+// literalLength returns how many literal characters a pattern has, those
+// of every matcher for selectors.
+func literalLength(pattern string) int {
+	if (domain.Mapping{Pattern: pattern}).IsSelector() {
+		matchers, err := parser.ParseMetricSelector(pattern)
+		if err != nil {
+			return 0
+		}
+
+		length := 0
+		for _, matcher := range matchers {
+			switch matcher.Type {
+			case labels.MatchEqual:
+				length += len(matcher.Value)
+			case labels.MatchRegexp:
+				length += literalLength(matcher.Value)
+			}
+		}
+		return length
+	}
+
+	re := parsePattern(pattern)
+	if re == nil {
+		return len(pattern)
+	}
+
+	if re.Op == syntax.OpLiteral {
+		return len(string(re.Rune))
+	}
+
+	length := 0
+	if re.Op == syntax.OpConcat {
+		for _, sub := range re.Sub {
+			if sub.Op == syntax.OpLiteral {
+				length += len(string(sub.Rune))
+			}
+		}
+	}
+	return length
+}
+
+func parsePattern(pattern string) *syntax.Regexp {
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return nil
+	}
+	re = re.Simplify()
+
+	for re.Op == syntax.OpCapture {
+		re = re.Sub[0]
+	}
+	return re
+}
+
+func (n *trieNode) insert(prefix string, pattern int) {
+	node := n
+	for i := 0; i < len(prefix); i++ {
+		child, ok := node.children[prefix[i]]
+		if !ok {
+			if node.children == nil {
+				node.children = make(map[byte]*trieNode)
+			}
+			child = &trieNode{}
+			node.children[prefix[i]] = child
+		}
+		node = child
+	}
+	node.patterns = append(node.patterns, pattern)
+}
+
+func (idx *mappingIndex) lookup(value string) *domain.SourceData {
+	return idx.lookupSeries(value, nil)
+}
+
+// lookupSeries also considers the mappings keyed on a selector.
+func (idx *mappingIndex) lookupSeries(value string, metric map[string]string) *domain.SourceData {
+	best, ok := idx.exact[value]
+	if !ok {
+		best = -1
+	}
+
+	for start := 0; start < len(value); start++ {
+		node := idx.trie
+		for i := start; i < len(value); i++ {
+			node = node.children[value[i]]
+			if node == nil {
+				break
+			}
+
+			for _, p := range node.patterns {
+				if best != -1 && p >= best {
+					continue
+				}
+				if idx.patterns[p].literal || idx.patterns[p].regex.MatchString(value) {
+					best = p
+				}
+			}
+		}
+	}
+
+	if len(idx.combinedPatterns) > 0 && (best == -1 || idx.combinedPatterns[0] < best) {
+		best = idx.lookupCombined(value, best)
+	}
+
+	if metric != nil {
+		for _, selector := range idx.selectors {
+			if best != -1 && selector.mapping >= best {
+				break
+			}
+			if matchesMetric(selector.matchers, metric) {
+				best = selector.mapping
+				break
+			}
+		}
+	}
+
+	if best == -1 {
+		return nil
+	}
+
+	pattern := idx.patterns[best]
+	if pattern.templated && pattern.regex != nil {
+		return pattern.expand(value)
+	}
+	return pattern.data
+}
+
+// expand fills the references to the pattern capture groups (eg: `$team`)
+// in the mapping labels.
+func (p indexedPattern) expand(value string) *domain.SourceData {
+	match := p.regex.FindStringSubmatchIndex(value)
+	if match == nil {
+		return p.data
+	}
+
+	expand := func(templates map[string]string) map[string]string {
+		labels := make(map[string]string, len(templates))
+		for name, template := range templates {
+			if expanded := string(p.regex.ExpandString(nil, template, value, match)); expanded != "" {
+				labels[name] = expanded
+			}
+		}
+		return labels
+	}
+
+	data := *p.data
+	data.Labels = expand(p.data.Labels)
+	if len(p.data.Targets) > 0 {
+		data.Targets = make([]domain.Target, len(p.data.Targets))
+		for i, target := range p.data.Targets {
+			data.Targets[i] = target
+			data.Targets[i].Labels = expand(target.Labels)
+		}
+	}
+	return &data
+}
+
+func hasTemplate(labels map[string]string) bool {
+	for _, value := range labels {
+		if isTemplate(value) {
+			return true
+		}
+	}
+	return false
+}
+
+func isTemplate(value string) bool {
+	return strings.Contains(value, "$")
+}
+
+func matchesMetric(matchers []*labels.Matcher, metric map[string]string) bool {
+	for _, matcher := range matchers {
+		if !matcher.Matches(metric[matcher.Name]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (idx *mappingIndex) lookupCombined(value string, best int) int {
+	if idx.combined == nil {
+		for _, p := range idx.combinedPatterns {
+			if best != -1 && p >= best {
+				break
+			}
+			if idx.patterns[p].regex.MatchString(value) {
+				return p
+			}
+		}
+		return best
+	}
+
+	if match := idx.combined.FindStringSubmatchIndex(value); match != nil {
+		for i, group := range idx.combinedGroups {
+			if match[2*group] < 0 {
+				continue
+			}
+			if p := idx.combinedPatterns[i]; best == -1 || p < best {
+				return p
+			}
+			break
+		}
+	}
+
+	return best
+}
+
+// mappingIndex returns the index of a source mappings, rebuilt whenever
+// the source is refreshed.
+func (h *EnrichmentUseCase) mappingIndex(name string) (*mappingIndex, error) {
+	source, ok := h.sources[name]
+	if !ok {
+		return nil, fmt.Errorf("source %s not found", name)
+	}
+
+	// Read before the mappings, so a concurrent refresh isn't missed.
+	revision := source.Revision()
+
+	h.indexesMu.Lock()
+	cached, ok := h.indexes[name]
+	h.indexesMu.Unlock()
+
+	if ok && cached.revision == revision {
+		return cached.index, nil
+	}
+
+	mappings, err := source.GetMappings()
+	if err != nil {
+		return nil, fmt.Errorf("error getting mappings from source %s: %w", name, err)
+	}
+
+	var config domain.Source
+	for _, s := range h.config.Sources {
+		if s.Name == name {
+			config = s
+			break
+		}
+	}
+
+	index := newMappingIndex(mappings, config.MatchMode, config.Precedence)
+	index.weightsFrom = config.WeightsFrom
+
+	h.indexesMu.Lock()
+	h.indexes[name] = &cachedIndex{revision: revision, index: index}
+	h.indexesMu.Unlock()
+
+	return index, nil
+}
@@ -0,0 +1,282 @@
+package usecase
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"testing"
+
+	"github.com/lucianocarvalho/labelify/internal/domain"
+)
+
+func TestMappingIndex_Lookup(t *testing.T) {
+	mapping := func(pattern, team string) domain.Mapping {
+		return domain.Mapping{Pattern: pattern, SourceData: domain.SourceData{Labels: map[string]string{"team": team}}}
+	}
+
+	index := newMappingIndex(domain.Mappings{
+		mapping("coredns", "platform"),
+		mapping("microservice-.*", "engineering"),
+		mapping("billing-api-v2", "payments"),
+		mapping("billing-(api|worker)", "finance"),
+		mapping(".*-exporter", "observability"),
+		mapping("(?i)grafana", "observability-ui"),
+		mapping("invalid-(", "invalid"),
+	}, domain.MatchModePartial, domain.PrecedenceFirst)
+
+	testCases := []struct {
+		value    string
+		expected string
+	}{
+		{value: "coredns", expected: "platform"},
+		{value: "kube-coredns-1", expected: "platform"},
+		{value: "microservice-1", expected: "engineering"},
+		{value: "billing-worker", expected: "finance"},
+		{value: "billing-api-v2", expected: "payments"},
+		{value: "billing-api-v3", expected: "finance"},
+		{value: "node-exporter", expected: "observability"},
+		{value: "Grafana", expected: "observability-ui"},
+		{value: "invalid-(", expected: "invalid"},
+		{value: "prometheus", expected: ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run("given the value "+tc.value, func(t *testing.T) {
+			data := index.lookup(tc.value)
+
+			t.Run("then it should find the expected mapping", func(t *testing.T) {
+				team := ""
+				if data != nil {
+					team = data.Labels["team"]
+				}
+				if team != tc.expected {
+					t.Fatalf("expected team %q, got %q", tc.expected, team)
+				}
+			})
+		})
+	}
+}
+
+func TestMappingIndex_Precedence(t *testing.T) {
+	mappings := domain.Mappings{
+		{Pattern: "prometheus-.*", SourceData: domain.SourceData{Labels: map[string]string{"team": "observability"}}},
+		{Pattern: "prometheus-grafana", SourceData: domain.SourceData{Labels: map[string]string{"team": "dashboards"}}},
+		{Pattern: "coredns", SourceData: domain.SourceData{Labels: map[string]string{"team": "platform"}}, Priority: 5},
+		{Pattern: ".*", SourceData: domain.SourceData{Labels: map[string]string{"team": "everyone"}}, Priority: 10},
+	}
+
+	testCases := []struct {
+		name       string
+		matchMode  domain.MatchMode
+		precedence domain.Precedence
+		value      string
+		expected   string
+	}{
+		{name: "first match", precedence: domain.PrecedenceFirst, value: "prometheus-grafana", expected: "observability"},
+		{name: "longest literal", precedence: domain.PrecedenceLongestLiteral, value: "prometheus-grafana", expected: "dashboards"},
+		{name: "priority", precedence: domain.PrecedencePriority, value: "coredns", expected: "everyone"},
+		{name: "partial match", matchMode: domain.MatchModePartial, value: "coredns-autoscaler", expected: "platform"},
+		{name: "full match", matchMode: domain.MatchModeFull, value: "coredns-autoscaler", expected: "everyone"},
+		{name: "full match of a literal", matchMode: domain.MatchModeFull, value: "coredns", expected: "platform"},
+		{name: "full match of a regex", matchMode: domain.MatchModeFull, value: "my-prometheus-1", expected: "everyone"},
+	}
+
+	for _, tc := range testCases {
+		t.Run("given "+tc.name+" and the value "+tc.value, func(t *testing.T) {
+			data := newMappingIndex(mappings, tc.matchMode, tc.precedence).lookup(tc.value)
+
+			t.Run("then it should pick the expected mapping", func(t *testing.T) {
+				if data == nil || data.Labels["team"] != tc.expected {
+					t.Fatalf("expected team %q, got %+v", tc.expected, data)
+				}
+			})
+		})
+	}
+}
+
+func TestMappingIndex_Literals(t *testing.T) {
+	mappings := domain.Mappings{
+		{Pattern: `api\.v1`, SourceData: domain.SourceData{Labels: map[string]string{"team": "versioned"}}},
+		{Pattern: "(payments)", SourceData: domain.SourceData{Labels: map[string]string{"team": "$1"}}},
+		{Pattern: "^coredns$", SourceData: domain.SourceData{Labels: map[string]string{"team": "platform"}}},
+	}
+
+	testCases := []struct {
+		matchMode domain.MatchMode
+		value     string
+		expected  string
+	}{
+		{matchMode: domain.MatchModeFull, value: "api.v1", expected: "versioned"},
+		{matchMode: domain.MatchModeFull, value: `api\.v1`, expected: ""},
+		{matchMode: domain.MatchModeFull, value: "apixv1", expected: ""},
+		{matchMode: domain.MatchModeFull, value: "payments", expected: "payments"},
+		{matchMode: domain.MatchModeFull, value: "(payments)", expected: ""},
+		{matchMode: domain.MatchModePartial, value: "api.v1", expected: "versioned"},
+		{matchMode: domain.MatchModePartial, value: `api\.v1`, expected: ""},
+		{matchMode: domain.MatchModePartial, value: "payments-api", expected: "payments"},
+		{matchMode: domain.MatchModePartial, value: "coredns", expected: "platform"},
+		{matchMode: domain.MatchModePartial, value: "kube-coredns", expected: ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run("given "+string(tc.matchMode)+" matches and the value "+tc.value, func(t *testing.T) {
+			data := newMappingIndex(mappings, tc.matchMode, domain.PrecedenceFirst).lookup(tc.value)
+
+			t.Run("then it should match escaped and grouped literals by their value", func(t *testing.T) {
+				team := ""
+				if data != nil {
+					team = data.Labels["team"]
+				}
+				if team != tc.expected {
+					t.Fatalf("expected team %q, got %q", tc.expected, team)
+				}
+			})
+		})
+	}
+}
+
+func TestMappingIndex_Templates(t *testing.T) {
+	index := newMappingIndex(domain.Mappings{
+		{Pattern: "(?P<team>[a-z]+)-(api|worker)", SourceData: domain.SourceData{Labels: map[string]string{
+			"team":      "$team",
+			"component": "${2}",
+			"owner":     "team-$team",
+		}}},
+		{Pattern: "legacy-(?P<team>[a-z]+)?", SourceData: domain.SourceData{Labels: map[string]string{
+			"team": "$team",
+			"tier": "legacy",
+		}}},
+	}, domain.MatchModeFull, domain.PrecedenceFirst)
+
+	testCases := []struct {
+		value    string
+		expected map[string]string
+	}{
+		{value: "payments-api", expected: map[string]string{"team": "payments", "component": "api", "owner": "team-payments"}},
+		{value: "search-worker", expected: map[string]string{"team": "search", "component": "worker", "owner": "team-search"}},
+		{value: "legacy-", expected: map[string]string{"tier": "legacy"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run("given the value "+tc.value, func(t *testing.T) {
+			data := index.lookup(tc.value)
+
+			t.Run("then it should expand the capture groups in the labels", func(t *testing.T) {
+				if data == nil || !reflect.DeepEqual(data.Labels, tc.expected) {
+					t.Fatalf("expected %v, got %+v", tc.expected, data)
+				}
+			})
+		})
+	}
+}
+
+func TestMappingIndex_Selectors(t *testing.T) {
+	index := newMappingIndex(domain.Mappings{
+		{Pattern: `{namespace="payments", deployment=~"api.*"}`, SourceData: domain.SourceData{Labels: map[string]string{"team": "payments"}}},
+		{Pattern: `{namespace="search", deployment=~"api.*"}`, SourceData: domain.SourceData{Labels: map[string]string{"team": "search"}}},
+		{Pattern: "api-.*", SourceData: domain.SourceData{Labels: map[string]string{"team": "platform"}}},
+		{Pattern: `{cluster!~"eu-.*"}`, SourceData: domain.SourceData{Labels: map[string]string{"team": "us"}}},
+	}, domain.MatchModePartial, domain.PrecedenceFirst)
+
+	testCases := []struct {
+		name     string
+		metric   map[string]string
+		expected string
+	}{
+		{name: "api in payments", metric: map[string]string{"namespace": "payments", "deployment": "api-1", "cluster": "eu-1"}, expected: "payments"},
+		{name: "api in search", metric: map[string]string{"namespace": "search", "deployment": "api-1", "cluster": "eu-1"}, expected: "search"},
+		{name: "api elsewhere", metric: map[string]string{"namespace": "default", "deployment": "api-1", "cluster": "eu-1"}, expected: "platform"},
+		{name: "a series without the cluster label", metric: map[string]string{"namespace": "default", "deployment": "worker"}, expected: "us"},
+		{name: "an unknown series", metric: map[string]string{"namespace": "default", "deployment": "worker", "cluster": "eu-1"}, expected: ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run("given "+tc.name, func(t *testing.T) {
+			data := index.lookupSeries(tc.metric["deployment"], tc.metric)
+
+			t.Run("then it should evaluate the selectors against the whole series", func(t *testing.T) {
+				team := ""
+				if data != nil {
+					team = data.Labels["team"]
+				}
+				if team != tc.expected {
+					t.Fatalf("expected team %q, got %q", tc.expected, team)
+				}
+			})
+		})
+	}
+}
+
+// naiveLookup is how mappings used to be matched, as a baseline.
+func naiveLookup(labelValue string, mappings domain.Mappings) *domain.SourceData {
+	for _, mapping := range mappings {
+		if mapping.Pattern == labelValue {
+			return &mapping.SourceData
+		}
+		if matched, _ := regexp.MatchString(mapping.Pattern, labelValue); matched {
+			return &mapping.SourceData
+		}
+	}
+	return nil
+}
+
+func benchmarkMappings(size int) (domain.Mappings, []string) {
+	mappings := make(domain.Mappings, 0, size)
+	values := make([]string, 0, 100)
+
+	for i := 0; i < size; i++ {
+		mapping := domain.Mapping{SourceData: domain.SourceData{Labels: map[string]string{"team": fmt.Sprintf("team-%d", i%50)}}}
+		switch i % 10 {
+		case 0:
+			mapping.Pattern = fmt.Sprintf("service-%d-.*", i)
+		case 1:
+			mapping.Pattern = fmt.Sprintf(".*-worker-%d", i)
+		default:
+			mapping.Pattern = fmt.Sprintf("service-%d", i)
+		}
+		mappings = append(mappings, mapping)
+	}
+
+	for i := 0; i < 100; i++ {
+		n := i * size / 100
+		switch n % 10 {
+		case 0:
+			values = append(values, fmt.Sprintf("service-%d-abc12", n))
+		case 1:
+			values = append(values, fmt.Sprintf("queue-worker-%d", n))
+		default:
+			values = append(values, fmt.Sprintf("service-%d", n))
+		}
+	}
+
+	return mappings, values
+}
+
+func BenchmarkMappingLookup(b *testing.B) {
+	for _, size := range []int{100, 1000, 20000} {
+		mappings, values := benchmarkMappings(size)
+
+		if size <= 1000 {
+			b.Run(fmt.Sprintf("naive/%d", size), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					naiveLookup(values[i%len(values)], mappings)
+				}
+			})
+		}
+
+		b.Run(fmt.Sprintf("index/%d", size), func(b *testing.B) {
+			index := newMappingIndex(mappings, domain.MatchModePartial, domain.PrecedenceFirst)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				index.lookup(values[i%len(values)])
+			}
+		})
+	}
+}
+
+func BenchmarkMappingIndexBuild(b *testing.B) {
+	mappings, _ := benchmarkMappings(20000)
+	for i := 0; i < b.N; i++ {
+		newMappingIndex(mappings, domain.MatchModePartial, domain.PrecedenceFirst)
+	}
+}
@@ -0,0 +1,143 @@
+package usecase
+
+import (
+	"log"
+	"sort"
+
+	"github.com/lucianocarvalho/labelify/internal/domain"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+func (h *EnrichmentUseCase) EnrichLabelNames(names []string, matchers []string) []string {
+	labelSet := make(map[string]bool)
+	for _, name := range names {
+		labelSet[name] = true
+	}
+
+	for _, match := range h.rulesForMatchers(matchers) {
+		rule := match.rule
+		for _, label := range rule.enrichedLabels() {
+			labelSet[label] = true
+		}
+		for label := range rule.Fallback {
+			labelSet[label] = true
+		}
+	}
+
+	return sortedKeys(labelSet)
+}
+
+func (h *EnrichmentUseCase) EnrichLabelValues(name string, values []string, matchers []string) []string {
+	valueSet := make(map[string]bool)
+	for _, value := range values {
+		valueSet[value] = true
+	}
+
+	for _, match := range h.rulesForMatchers(matchers) {
+		rule := match.rule
+		// Values computed from the series can't be listed.
+		if fallback, ok := rule.fallbacks[name]; ok && fallback.static {
+			valueSet[fallback.text] = true
+		}
+
+		if !rule.AddLabels.Contains(name) {
+			continue
+		}
+		if value, ok := rule.values[name]; ok {
+			if value.static {
+				valueSet[value.text] = true
+			}
+			continue
+		}
+
+		for _, candidate := range rule.candidates {
+			source, ok := h.sources[candidate.EnrichFrom]
+			if !ok {
+				log.Printf("Source %s not found for rule", candidate.EnrichFrom)
+				continue
+			}
+
+			mappings, err := source.GetMappings()
+			if err != nil {
+				log.Printf("Error getting mappings from source %s: %v", candidate.EnrichFrom, err)
+				continue
+			}
+
+			for _, mapping := range mappings {
+				for _, labels := range mapping.LabelSets() {
+					// Values taken from capture groups can't be listed.
+					if value, ok := labels[name]; ok && !isTemplate(value) {
+						valueSet[value] = true
+					}
+				}
+			}
+		}
+	}
+
+	return sortedKeys(valueSet)
+}
+
+// EnrichSeries enriches the series in place, and returns them along with
+// the copies of the ones fanned out to several targets, minus the ones
+// dropped by relabel steps.
+func (h *EnrichmentUseCase) EnrichSeries(series []map[string]string, matchers []string) []map[string]string {
+	resp := &domain.QueryResponse{
+		Data: domain.QueryData{
+			Result: make([]domain.MetricData, len(series)),
+		},
+	}
+
+	// Metric maps are shared, so the series are enriched in place.
+	for i, metric := range series {
+		resp.Data.Result[i].Metric = metric
+	}
+
+	// Series have no values to split by the target weights.
+	if err := h.enrichMetrics(resp, h.rulesForMatchers(matchers), true); err != nil {
+		log.Printf("Error enriching series: %v", err)
+	}
+
+	kept := make([]map[string]string, 0, len(resp.Data.Result))
+	for _, r := range resp.Data.Result {
+		kept = append(kept, r.Metric)
+	}
+	return kept
+}
+
+// rulesForMatchers returns the rules matching the match[] selectors, or
+// every rule when there are none.
+func (h *EnrichmentUseCase) rulesForMatchers(matchers []string) []*ruleMatch {
+	selectors := make([]*parser.VectorSelector, 0, len(matchers))
+	for _, matcher := range matchers {
+		labelMatchers, err := parser.ParseMetricSelector(matcher)
+		if err != nil {
+			log.Printf("Error parsing selector %s: %v", matcher, err)
+			continue
+		}
+		selectors = append(selectors, &parser.VectorSelector{LabelMatchers: labelMatchers})
+	}
+
+	var matches []*ruleMatch
+	for _, rule := range h.rules {
+		match := &ruleMatch{rule: rule}
+		for _, vs := range selectors {
+			if rule.matchesSelector(vs) {
+				match.selectors = append(match.selectors, vs)
+			}
+		}
+
+		if len(matchers) == 0 || len(match.selectors) > 0 {
+			matches = append(matches, match)
+		}
+	}
+	return matches
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
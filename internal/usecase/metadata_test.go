@@ -0,0 +1,115 @@
+package usecase
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/lucianocarvalho/labelify/internal/domain"
+)
+
+func TestEnrichmentUseCase_Metadata(t *testing.T) {
+	config := &domain.Config{
+		Sources: []domain.Source{
+			{
+				Name: "just-a-random-source",
+				Type: "yaml",
+				Mappings: domain.Mappings{
+					{
+						Pattern: "microservice-.*",
+						SourceData: domain.SourceData{
+							Labels: map[string]string{
+								"team": "engineering",
+							},
+						},
+					},
+					{
+						Pattern: "coredns",
+						SourceData: domain.SourceData{
+							Labels: map[string]string{
+								"team": "networking",
+							},
+						},
+					},
+				},
+			},
+		},
+		Enrichment: domain.Enrichment{
+			Rules: []domain.EnrichmentRule{
+				{
+					Match:      domain.MatchRule{Metric: "kube_deployment_spec_replicas", Label: "deployment"},
+					EnrichFrom: "just-a-random-source",
+					AddLabels:  domain.AddLabels{{Name: "team"}},
+					Fallback: map[string]string{
+						"team": "unknown",
+					},
+				},
+			},
+		},
+	}
+
+	uc, err := NewEnrichmentUseCase(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("given a list of label names", func(t *testing.T) {
+		names := []string{"__name__", "deployment", "namespace"}
+
+		t.Run("when matching the enriched metric then it should include the added labels", func(t *testing.T) {
+			expected := []string{"__name__", "deployment", "namespace", "team"}
+			result := uc.EnrichLabelNames(names, []string{"kube_deployment_spec_replicas"})
+
+			if !reflect.DeepEqual(result, expected) {
+				t.Fatalf("expected %+v, got %+v", expected, result)
+			}
+		})
+
+		t.Run("when matching another metric then it should return the original labels", func(t *testing.T) {
+			result := uc.EnrichLabelNames(names, []string{"up"})
+
+			if !reflect.DeepEqual(result, names) {
+				t.Fatalf("expected %+v, got %+v", names, result)
+			}
+		})
+
+		t.Run("when there are no matchers then it should include every added label", func(t *testing.T) {
+			expected := []string{"__name__", "deployment", "namespace", "team"}
+			result := uc.EnrichLabelNames(names, nil)
+
+			if !reflect.DeepEqual(result, expected) {
+				t.Fatalf("expected %+v, got %+v", expected, result)
+			}
+		})
+	})
+
+	t.Run("given a synthetic label name", func(t *testing.T) {
+		t.Run("then it should return the source and fallback values", func(t *testing.T) {
+			expected := []string{"engineering", "networking", "unknown"}
+			result := uc.EnrichLabelValues("team", []string{}, []string{"kube_deployment_spec_replicas"})
+
+			if !reflect.DeepEqual(result, expected) {
+				t.Fatalf("expected %+v, got %+v", expected, result)
+			}
+		})
+	})
+
+	t.Run("given a list of series", func(t *testing.T) {
+		series := []map[string]string{
+			{"__name__": "kube_deployment_spec_replicas", "deployment": "coredns"},
+			{"__name__": "kube_deployment_spec_replicas", "deployment": "local-path-provisioner"},
+		}
+
+		uc.EnrichSeries(series, []string{"kube_deployment_spec_replicas"})
+
+		t.Run("then it should add the enriched labels to each series", func(t *testing.T) {
+			expected := []map[string]string{
+				{"__name__": "kube_deployment_spec_replicas", "deployment": "coredns", "team": "networking"},
+				{"__name__": "kube_deployment_spec_replicas", "deployment": "local-path-provisioner", "team": "unknown"},
+			}
+
+			if !reflect.DeepEqual(series, expected) {
+				t.Fatalf("expected %+v, got %+v", expected, series)
+			}
+		})
+	})
+}
@@ -0,0 +1,115 @@
+package usecase
+
+import (
+	"fmt"
+
+	"github.com/lucianocarvalho/labelify/internal/domain"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+func unwrapParens(expr parser.Expr) parser.Expr {
+	for {
+		paren, ok := expr.(*parser.ParenExpr)
+		if !ok {
+			return expr
+		}
+		expr = paren.Expr
+	}
+}
+
+func outermostAggregation(expr parser.Expr) *parser.AggregateExpr {
+	for {
+		switch e := expr.(type) {
+		case *parser.ParenExpr:
+			expr = e.Expr
+		case *parser.StepInvariantExpr:
+			expr = e.Expr
+		case *parser.AggregateExpr:
+			return e
+		default:
+			return nil
+		}
+	}
+}
+
+// mergeAggregation returns how groups produced by the given PromQL
+// aggregation can be merged again after enrichment. Counts are merged by
+// adding them, while averages, quantiles and friends can't be merged at all.
+func mergeAggregation(op parser.ItemType) (domain.Aggregation, error) {
+	switch op {
+	case parser.SUM, parser.COUNT:
+		return domain.AggregationSum, nil
+	case parser.MIN:
+		return domain.AggregationMin, nil
+	case parser.MAX:
+		return domain.AggregationMax, nil
+	case parser.GROUP:
+		return domain.AggregationGroup, nil
+	default:
+		return "", fmt.Errorf("%s results can't be merged correctly, enriched series were not regrouped", op)
+	}
+}
+
+// resultSelectors returns the selectors whose labels can show up in the
+// query result. For binary operations, that's the side driving the
+// vector matching (or both sides, for `or`).
+func resultSelectors(expr parser.Expr) []*parser.VectorSelector {
+	switch e := expr.(type) {
+	case *parser.VectorSelector:
+		return []*parser.VectorSelector{e}
+	case *parser.MatrixSelector:
+		return resultSelectors(e.VectorSelector)
+	case *parser.SubqueryExpr:
+		return resultSelectors(e.Expr)
+	case *parser.ParenExpr:
+		return resultSelectors(e.Expr)
+	case *parser.StepInvariantExpr:
+		return resultSelectors(e.Expr)
+	case *parser.UnaryExpr:
+		return resultSelectors(e.Expr)
+	case *parser.AggregateExpr:
+		return resultSelectors(e.Expr)
+	case *parser.Call:
+		var selectors []*parser.VectorSelector
+		for _, arg := range e.Args {
+			if arg.Type() == parser.ValueTypeVector || arg.Type() == parser.ValueTypeMatrix {
+				selectors = append(selectors, resultSelectors(arg)...)
+			}
+		}
+		return selectors
+	case *parser.BinaryExpr:
+		lhsVector := e.LHS.Type() == parser.ValueTypeVector
+		rhsVector := e.RHS.Type() == parser.ValueTypeVector
+
+		switch {
+		case lhsVector && rhsVector && e.Op == parser.LOR:
+			return append(resultSelectors(e.LHS), resultSelectors(e.RHS)...)
+		case lhsVector && rhsVector && e.VectorMatching != nil && e.VectorMatching.Card == parser.CardOneToMany:
+			return resultSelectors(e.RHS)
+		case lhsVector:
+			return resultSelectors(e.LHS)
+		case rhsVector:
+			return resultSelectors(e.RHS)
+		}
+	}
+	return nil
+}
+
+func pinnedValue(vs *parser.VectorSelector, name string) (string, bool) {
+	for _, matcher := range vs.LabelMatchers {
+		if matcher.Name == name && matcher.Type == labels.MatchEqual {
+			return matcher.Value, true
+		}
+	}
+	return "", false
+}
+
+func hasMatcher(vs *parser.VectorSelector, matcher *labels.Matcher) bool {
+	for _, m := range vs.LabelMatchers {
+		if m.Name == matcher.Name && m.Type == matcher.Type && m.Value == matcher.Value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,321 @@
+package usecase
+
+import (
+	"log"
+	"regexp"
+	"regexp/syntax"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/lucianocarvalho/labelify/internal/domain"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+const matchNothing = `[^\s\S]`
+
+var captureReference = regexp.MustCompile(`^\$(?:(\w+)|\{(\w+)\})$`)
+
+// RewriteQuery turns groupings and matchers on enriched labels into ones on
+// the rules source labels, which Prometheus knows about. It returns false
+// when the query was left untouched. Groupings are left as they are in keep
+// mode, since the results aren't regrouped.
+func (h *EnrichmentUseCase) RewriteQuery(request domain.QueryRequest) (string, bool) {
+	query := request.Query
+	expr, err := parser.ParseExpr(query)
+	if err != nil {
+		return query, false
+	}
+
+	changed := false
+	if h.getMode(request, h.matchRules(expr)) != domain.EnrichmentModeKeep {
+		changed = h.pushDownGrouping(expr)
+	}
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		if vs, ok := node.(*parser.VectorSelector); ok && h.rewriteSelector(vs) {
+			changed = true
+		}
+		return nil
+	})
+
+	if !changed {
+		return query, false
+	}
+
+	rewritten := expr.String()
+	log.Printf("Rewrote query '%s' to '%s'", query, rewritten)
+
+	return rewritten, true
+}
+
+// pushDownGrouping makes the outermost aggregation group by the rules
+// source labels, the result being regrouped once enriched.
+func (h *EnrichmentUseCase) pushDownGrouping(expr parser.Expr) bool {
+	aggregate := outermostAggregation(expr)
+	if aggregate == nil || aggregate.Without {
+		return false
+	}
+
+	if _, err := mergeAggregation(aggregate.Op); err != nil {
+		return false
+	}
+
+	sourceLabels := make(map[string][]string)
+	for _, match := range h.matchRules(aggregate) {
+		for _, label := range match.rule.enrichedLabels() {
+			if _, ok := sourceLabels[label]; !ok && !slices.Contains(match.rule.candidateLabels(), label) {
+				sourceLabels[label] = match.rule.sourceLabels(label)
+			}
+		}
+	}
+
+	changed := false
+	grouping := make([]string, 0, len(aggregate.Grouping))
+	for _, label := range aggregate.Grouping {
+		sources, ok := sourceLabels[label]
+		if !ok {
+			sources = []string{label}
+		} else {
+			changed = true
+		}
+		for _, source := range sources {
+			if !slices.Contains(grouping, source) {
+				grouping = append(grouping, source)
+			}
+		}
+	}
+
+	if changed {
+		aggregate.Grouping = grouping
+	}
+	return changed
+}
+
+func (h *EnrichmentUseCase) rewriteSelector(vs *parser.VectorSelector) bool {
+	changed := false
+	matchers := make([]*labels.Matcher, 0, len(vs.LabelMatchers))
+
+	for _, matcher := range vs.LabelMatchers {
+		rule := h.ruleEnriching(vs, matcher.Name)
+		if rule == nil {
+			matchers = append(matchers, matcher)
+			continue
+		}
+
+		rewritten, err := h.rewriteMatcher(rule, matcher)
+		if err != nil {
+			log.Printf("Error rewriting matcher %s: %v", matcher, err)
+			matchers = append(matchers, matcher)
+			continue
+		}
+
+		matchers = append(matchers, rewritten...)
+		changed = true
+	}
+
+	vs.LabelMatchers = matchers
+	return changed
+}
+
+func (h *EnrichmentUseCase) ruleEnriching(vs *parser.VectorSelector, label string) *enrichmentRule {
+	if label == labels.MetricName {
+		return nil
+	}
+
+	for _, rule := range h.rules {
+		if len(rule.candidates) != 1 || rule.candidates[0].Extract != "" || rule.when != nil {
+			continue
+		}
+		if rule.candidates[0].Label == label || !rule.AddLabels.Contains(label) || rule.computed(label) {
+			continue
+		}
+		if rule.matchesSelector(vs) {
+			return rule
+		}
+	}
+	return nil
+}
+
+func (h *EnrichmentUseCase) rewriteMatcher(rule *enrichmentRule, matcher *labels.Matcher) ([]*labels.Matcher, error) {
+	source := rule.candidates[0]
+	index, err := h.mappingIndex(source.EnrichFrom)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only the mappings ranked above every satisfying one can be excluded,
+	// since the others may be shadowed by a satisfying mapping.
+	var satisfying, others []string
+	for _, mapping := range index.mappings {
+		excludable := !mapping.IsSelector() && len(satisfying) == 0
+		selected := false
+
+		for _, labelSet := range mapping.LabelSets() {
+			value := labelSet[matcher.Name]
+			if t, ok := rule.values[matcher.Name]; ok {
+				value = t.text
+			}
+			if isTemplate(value) {
+				excludable = false
+			}
+
+			if pattern, ok := matchingPattern(mapping, value, source.Label, matcher); ok {
+				if !slices.Contains(satisfying, pattern) {
+					satisfying = append(satisfying, pattern)
+				}
+				selected = true
+			}
+		}
+
+		if !selected && excludable {
+			others = append(others, mapping.Pattern)
+		}
+	}
+
+	var rewritten []*labels.Matcher
+
+	// When the fallback value matches, series without a mapping are selected too.
+	fallback := matcher.Matches(rule.Fallback[matcher.Name])
+	if !fallback {
+		m, err := labels.NewMatcher(labels.MatchRegexp, source.Label, mappingsRegex(satisfying, index.fullMatch))
+		if err != nil {
+			return nil, err
+		}
+		rewritten = append(rewritten, m)
+	}
+
+	if len(others) > 0 && (fallback || len(satisfying) > 0) {
+		m, err := labels.NewMatcher(labels.MatchNotRegexp, source.Label, mappingsRegex(others, index.fullMatch))
+		if err != nil {
+			return nil, err
+		}
+		rewritten = append(rewritten, m)
+	}
+
+	if !matcher.Matches("") {
+		m, err := labels.NewMatcher(labels.MatchNotEqual, source.Label, "")
+		if err != nil {
+			return nil, err
+		}
+		rewritten = append(rewritten, m)
+	}
+
+	return rewritten, nil
+}
+
+// matchingPattern returns the pattern selecting the source label values a
+// mapping applies to, when the value it gives satisfies the matcher.
+func matchingPattern(mapping domain.Mapping, value, label string, matcher *labels.Matcher) (string, bool) {
+	if mapping.IsSelector() {
+		if matcher.Matches(value) || isTemplate(value) {
+			return sourceLabelPattern(mapping.Pattern, label), true
+		}
+		return "", false
+	}
+
+	if isTemplate(value) {
+		pattern, ok := capturePattern(mapping.Pattern, value, matcher)
+		if !ok {
+			pattern = mapping.Pattern
+		}
+		return pattern, pattern != ""
+	}
+
+	return mapping.Pattern, matcher.Matches(value)
+}
+
+// capturePattern pins the capture group referenced by template (eg: `$team`)
+// to the value of an equality matcher. It returns an empty pattern when no
+// value can match, and false when the matcher or template aren't supported.
+func capturePattern(pattern, template string, matcher *labels.Matcher) (string, bool) {
+	if matcher.Type != labels.MatchEqual {
+		return "", false
+	}
+
+	ref := captureReference.FindStringSubmatch(template)
+	if ref == nil {
+		return "", false
+	}
+	name := ref[1] + ref[2]
+
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return "", false
+	}
+
+	number, numberErr := strconv.Atoi(name)
+
+	var capture *syntax.Regexp
+	var find func(node *syntax.Regexp)
+	find = func(node *syntax.Regexp) {
+		if capture != nil {
+			return
+		}
+		if node.Op == syntax.OpCapture && (numberErr == nil && node.Cap == number || node.Name == name) {
+			capture = node
+			return
+		}
+		for _, sub := range node.Sub {
+			find(sub)
+		}
+	}
+	find(re)
+
+	if capture == nil {
+		return "", false
+	}
+
+	group, err := regexp.Compile("^(?:" + capture.Sub[0].String() + ")$")
+	if err != nil {
+		return "", false
+	}
+	if !group.MatchString(matcher.Value) {
+		return "", true
+	}
+
+	*capture = syntax.Regexp{Op: syntax.OpLiteral, Rune: []rune(matcher.Value)}
+	return re.String(), true
+}
+
+func sourceLabelPattern(selector, label string) string {
+	matchers, err := parser.ParseMetricSelector(selector)
+	if err != nil {
+		return matchNothing
+	}
+
+	for _, matcher := range matchers {
+		if matcher.Name != label {
+			continue
+		}
+		switch matcher.Type {
+		case labels.MatchEqual:
+			return "^" + regexp.QuoteMeta(matcher.Value) + "$"
+		case labels.MatchRegexp:
+			return "^(?:" + matcher.Value + ")$"
+		}
+	}
+	return ".*"
+}
+
+// mappingsRegex builds a single matcher regex, which Prometheus anchors,
+// matching the same values as the given mapping patterns.
+func mappingsRegex(patterns []string, fullMatch bool) string {
+	if len(patterns) == 0 {
+		return matchNothing
+	}
+
+	alternatives := make([]string, 0, len(patterns))
+	for _, pattern := range patterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			alternatives = append(alternatives, regexp.QuoteMeta(pattern))
+			continue
+		}
+		if fullMatch {
+			alternatives = append(alternatives, "(?:"+pattern+")")
+		} else {
+			alternatives = append(alternatives, ".*(?:"+pattern+").*")
+		}
+	}
+	return strings.Join(alternatives, "|")
+}
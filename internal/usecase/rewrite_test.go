@@ -0,0 +1,214 @@
+package usecase
+
+import (
+	"testing"
+
+	"github.com/lucianocarvalho/labelify/internal/domain"
+)
+
+func TestEnrichmentUseCase_RewriteQuery(t *testing.T) {
+	config := &domain.Config{
+		Sources: []domain.Source{
+			{
+				Name: "just-a-random-source",
+				Type: "yaml",
+				Mappings: domain.Mappings{
+					{
+						Pattern: "microservice-.*",
+						SourceData: domain.SourceData{
+							Labels: map[string]string{
+								"team": "engineering",
+							},
+						},
+					},
+					{
+						Pattern: "billing-.*",
+						SourceData: domain.SourceData{
+							Labels: map[string]string{
+								"team": "finance",
+							},
+						},
+					},
+				},
+			},
+			{
+				Name: "overlapping-source",
+				Type: "yaml",
+				Mappings: domain.Mappings{
+					{
+						Pattern: "prometheus-grafana",
+						SourceData: domain.SourceData{
+							Labels: map[string]string{
+								"team": "dashboards",
+							},
+						},
+					},
+					{
+						Pattern: "prometheus-.*",
+						SourceData: domain.SourceData{
+							Labels: map[string]string{
+								"team": "observability",
+							},
+						},
+					},
+				},
+			},
+			{
+				Name: "templated-source",
+				Type: "yaml",
+				Mappings: domain.Mappings{
+					{
+						Pattern: "(?P<team>[a-z]+)-svc",
+						SourceData: domain.SourceData{
+							Labels: map[string]string{
+								"team": "$team",
+							},
+						},
+					},
+				},
+			},
+		},
+		Enrichment: domain.Enrichment{
+			Rules: []domain.EnrichmentRule{
+				{
+					Match:      domain.MatchRule{Metric: "kube_deployment_spec_replicas", Label: "deployment"},
+					EnrichFrom: "just-a-random-source",
+					AddLabels:  domain.AddLabels{{Name: "team"}},
+					Fallback: map[string]string{
+						"team": "unknown",
+					},
+				},
+				{
+					Match:      domain.MatchRule{Metric: "kube_deployment_status_replicas_available", Label: "deployment"},
+					EnrichFrom: "overlapping-source",
+					AddLabels:  domain.AddLabels{{Name: "team"}},
+				},
+				{
+					Match:      domain.MatchRule{Metric: "kube_pod_info", Label: "pod"},
+					EnrichFrom: "templated-source",
+					AddLabels:  domain.AddLabels{{Name: "team"}},
+				},
+			},
+		},
+	}
+
+	uc, err := NewEnrichmentUseCase(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name      string
+		query     string
+		mode      domain.EnrichmentMode
+		expected  string
+		rewritten bool
+	}{
+		{
+			name:      "an equality matcher on an enriched label",
+			query:     `sum(kube_deployment_spec_replicas{team="engineering"}) by (team)`,
+			expected:  `sum by (deployment) (kube_deployment_spec_replicas{deployment!="",deployment=~".*(?:microservice-.*).*"})`,
+			rewritten: true,
+		},
+		{
+			name:      "an aggregation grouped by an enriched label",
+			query:     `sum(rate(kube_deployment_spec_replicas[5m])) by (team, namespace)`,
+			expected:  `sum by (deployment, namespace) (rate(kube_deployment_spec_replicas[5m]))`,
+			rewritten: true,
+		},
+		{
+			name:      "an aggregation grouped by both the enriched and the source label",
+			query:     `max(kube_deployment_spec_replicas) by (deployment, team)`,
+			expected:  `max by (deployment) (kube_deployment_spec_replicas)`,
+			rewritten: true,
+		},
+		{
+			name:      "an aggregation grouped by an enriched label in keep mode",
+			query:     `sum(kube_deployment_spec_replicas{team="engineering"}) by (team)`,
+			mode:      domain.EnrichmentModeKeep,
+			expected:  `sum by (team) (kube_deployment_spec_replicas{deployment!="",deployment=~".*(?:microservice-.*).*"})`,
+			rewritten: true,
+		},
+		{
+			name:      "an aggregation whose groups can't be merged",
+			query:     `avg(kube_deployment_spec_replicas) by (team)`,
+			expected:  `avg(kube_deployment_spec_replicas) by (team)`,
+			rewritten: false,
+		},
+		{
+			name:      "a regex matcher on an enriched label",
+			query:     `kube_deployment_spec_replicas{team=~"engineering|finance"}`,
+			expected:  `kube_deployment_spec_replicas{deployment!="",deployment=~".*(?:microservice-.*).*|.*(?:billing-.*).*"}`,
+			rewritten: true,
+		},
+		{
+			name:      "a matcher satisfied by the fallback value",
+			query:     `kube_deployment_spec_replicas{team!="engineering"}`,
+			expected:  `kube_deployment_spec_replicas{deployment!~".*(?:microservice-.*).*"}`,
+			rewritten: true,
+		},
+		{
+			name:      "a matcher satisfied by the fallback value and by a higher ranked mapping",
+			query:     `kube_deployment_spec_replicas{team!="finance"}`,
+			expected:  `kube_deployment_spec_replicas`,
+			rewritten: true,
+		},
+		{
+			name:      "a matcher on the value of a mapping shadowed by a higher ranked one",
+			query:     `kube_deployment_status_replicas_available{team="observability"}`,
+			expected:  `kube_deployment_status_replicas_available{deployment!="",deployment!~".*(?:prometheus-grafana).*",deployment=~".*(?:prometheus-.*).*"}`,
+			rewritten: true,
+		},
+		{
+			name:      "a matcher on the value of the higher ranked mapping",
+			query:     `kube_deployment_status_replicas_available{team="dashboards"}`,
+			expected:  `kube_deployment_status_replicas_available{deployment!="",deployment=~".*(?:prometheus-grafana).*"}`,
+			rewritten: true,
+		},
+		{
+			name:      "a matcher no mapping satisfies",
+			query:     `kube_deployment_spec_replicas{team="marketing"}`,
+			expected:  `kube_deployment_spec_replicas{deployment!="",deployment=~"[^\\s\\S]"}`,
+			rewritten: true,
+		},
+		{
+			name:      "an equality matcher on a label taken from a capture group",
+			query:     `kube_pod_info{team="payments"}`,
+			expected:  `kube_pod_info{pod!="",pod=~".*(?:payments-svc).*"}`,
+			rewritten: true,
+		},
+		{
+			name:      "a regex matcher on a label taken from a capture group",
+			query:     `kube_pod_info{team=~"pay.*"}`,
+			expected:  `kube_pod_info{pod!="",pod=~".*(?:(?P<team>[a-z]+)-svc).*"}`,
+			rewritten: true,
+		},
+		{
+			name:      "a matcher on a label not added by the rules",
+			query:     `kube_deployment_spec_replicas{namespace="default"}`,
+			expected:  `kube_deployment_spec_replicas{namespace="default"}`,
+			rewritten: false,
+		},
+		{
+			name:      "a matcher on a metric not matched by the rules",
+			query:     `up{team="engineering"}`,
+			expected:  `up{team="engineering"}`,
+			rewritten: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run("given "+tc.name, func(t *testing.T) {
+			query, rewritten := uc.RewriteQuery(domain.QueryRequest{Query: tc.query, Mode: tc.mode})
+
+			t.Run("then it should rewrite the query accordingly", func(t *testing.T) {
+				if rewritten != tc.rewritten {
+					t.Fatalf("expected rewritten %v, got %v", tc.rewritten, rewritten)
+				}
+				if query != tc.expected {
+					t.Fatalf("expected %s, got %s", tc.expected, query)
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,253 @@
+package usecase
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/lucianocarvalho/labelify/internal/domain"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/relabel"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+type enrichmentRule struct {
+	domain.EnrichmentRule
+	matchers []*labels.Matcher
+	// Templates of the add_labels with a value and of the fallbacks.
+	values    map[string]*labelTemplate
+	fallbacks map[string]*labelTemplate
+	// Nil when the rule applies to every series.
+	when domain.Condition
+	// Labels looked up in order, each one in its source.
+	candidates []domain.MatchLabel
+}
+
+// ruleMatch is a rule applicable to a query, along with the query selectors
+// it matched.
+type ruleMatch struct {
+	rule      *enrichmentRule
+	selectors []*parser.VectorSelector
+}
+
+func compileRule(rule domain.EnrichmentRule) (*enrichmentRule, error) {
+	matchers, err := parseMetricMatchers(rule.Match.Metric)
+	if err != nil {
+		return nil, err
+	}
+
+	var when domain.Condition
+	if rule.When != "" {
+		when, err = domain.ParseCondition(rule.When)
+		if err != nil {
+			return nil, fmt.Errorf("invalid when: %w", err)
+		}
+	}
+
+	candidates := []domain.MatchLabel{{Label: rule.Match.Label, Extract: rule.Match.Extract}}
+	if len(rule.Match.Labels) > 0 {
+		candidates = append([]domain.MatchLabel(nil), rule.Match.Labels...)
+	}
+	for i := range candidates {
+		if candidates[i].EnrichFrom == "" {
+			candidates[i].EnrichFrom = rule.EnrichFrom
+		}
+	}
+
+	values := make(map[string]*labelTemplate)
+	for _, label := range rule.AddLabels {
+		if label.Value == "" {
+			continue
+		}
+		values[label.Name], err = compileTemplate(label.Name, label.Value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of label %s: %w", label.Name, err)
+		}
+	}
+
+	fallbacks := make(map[string]*labelTemplate, len(rule.Fallback))
+	for label, value := range rule.Fallback {
+		fallbacks[label], err = compileTemplate(label, value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid fallback of label %s: %w", label, err)
+		}
+	}
+
+	return &enrichmentRule{
+		EnrichmentRule: rule,
+		matchers:       matchers,
+		values:         values,
+		fallbacks:      fallbacks,
+		when:           when,
+		candidates:     candidates,
+	}, nil
+}
+
+// computed tells whether the values of an enriched label are computed from
+// the series, so they can't be known in advance.
+func (r *enrichmentRule) computed(label string) bool {
+	if value, ok := r.values[label]; ok && !value.static {
+		return true
+	}
+	if fallback, ok := r.fallbacks[label]; ok && !fallback.static {
+		return true
+	}
+	for _, cfg := range r.RelabelConfigs {
+		switch {
+		case cfg.Action == relabel.LabelMap, cfg.Action == relabel.LabelKeep, cfg.Action == relabel.LabelDrop:
+			return true
+		case cfg.TargetLabel == label:
+			return true
+		}
+	}
+	return false
+}
+
+// enrichedLabels returns the labels added by the rule: its add_labels and
+// the labels written by its relabel steps.
+func (r *enrichmentRule) enrichedLabels() []string {
+	labels := r.AddLabels.Names()
+	for _, cfg := range r.RelabelConfigs {
+		switch cfg.Action {
+		case relabel.Replace, relabel.HashMod, relabel.Lowercase, relabel.Uppercase:
+			// Targets referencing capture groups can't be known in advance.
+			if !strings.Contains(cfg.TargetLabel, "$") && !slices.Contains(labels, cfg.TargetLabel) {
+				labels = append(labels, cfg.TargetLabel)
+			}
+		}
+	}
+	return labels
+}
+
+// sourceLabels returns the series labels an enriched label is computed
+// from: the rule source labels, the ones referenced by its templates and
+// the ones its condition and relabel steps depend on.
+func (r *enrichmentRule) sourceLabels(label string) []string {
+	names := []string{}
+	for _, t := range []*labelTemplate{r.values[label], r.fallbacks[label]} {
+		if t != nil {
+			names = append(names, t.labels...)
+		}
+	}
+	if r.when != nil {
+		names = append(names, r.when.Labels()...)
+	}
+	for _, cfg := range r.RelabelConfigs {
+		for _, name := range cfg.SourceLabels {
+			names = append(names, string(name))
+		}
+	}
+
+	labels := r.candidateLabels()
+	for _, name := range names {
+		if !slices.Contains(labels, name) {
+			labels = append(labels, name)
+		}
+	}
+	return labels
+}
+
+// candidateLabels returns the labels the rule looks up, in order.
+func (r *enrichmentRule) candidateLabels() []string {
+	labels := make([]string, 0, len(r.candidates))
+	for _, candidate := range r.candidates {
+		labels = append(labels, candidate.Label)
+	}
+	return labels
+}
+
+// appliesTo tells whether the rule condition, if any, holds for a series.
+func (r *enrichmentRule) appliesTo(metric map[string]string) bool {
+	return r.when == nil || r.when.Matches(metric)
+}
+
+// parseMetricMatchers accepts an exact metric name, a series selector such
+// as `http_requests_total{job="api"}` or a regex on the metric name.
+func parseMetricMatchers(metric string) ([]*labels.Matcher, error) {
+	if metric == "" {
+		return nil, nil
+	}
+
+	if matchers, err := parser.ParseMetricSelector(metric); err == nil {
+		return matchers, nil
+	}
+
+	matcher, err := labels.NewMatcher(labels.MatchRegexp, labels.MetricName, metric)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metric %q: %w", metric, err)
+	}
+	return []*labels.Matcher{matcher}, nil
+}
+
+// matchesSelector tells whether the selector can select series matched by
+// the rule. Labels not pinned by the selector are checked later on each series.
+func (r *enrichmentRule) matchesSelector(vs *parser.VectorSelector) bool {
+	for _, matcher := range r.matchers {
+		if value, ok := pinnedValue(vs, matcher.Name); ok {
+			if !matcher.Matches(value) {
+				return false
+			}
+			continue
+		}
+
+		if matcher.Name == labels.MetricName && !hasMatcher(vs, matcher) {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *ruleMatch) matchesSeries(metric map[string]string) bool {
+	for _, matcher := range m.rule.matchers {
+		if value, ok := metric[matcher.Name]; ok {
+			if !matcher.Matches(value) {
+				return false
+			}
+			continue
+		}
+
+		// The label is gone (eg: aggregated away), so the selector must
+		// have been the one filtering by it.
+		if !m.pinnedBySelector(matcher) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchesFilters tells whether an enriched series satisfies the matchers
+// the query puts on the labels added by the rule. Rewritten queries may
+// select more series than asked for, so they're checked again here.
+func (m *ruleMatch) matchesFilters(metric map[string]string) bool {
+	enriched := m.rule.enrichedLabels()
+	candidates := m.rule.candidateLabels()
+
+	for _, vs := range m.selectors {
+		matches := true
+		for _, matcher := range vs.LabelMatchers {
+			if !slices.Contains(enriched, matcher.Name) || slices.Contains(candidates, matcher.Name) {
+				continue
+			}
+			if !matcher.Matches(metric[matcher.Name]) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *ruleMatch) pinnedBySelector(matcher *labels.Matcher) bool {
+	for _, vs := range m.selectors {
+		if value, ok := pinnedValue(vs, matcher.Name); ok && matcher.Matches(value) {
+			return true
+		}
+		if hasMatcher(vs, matcher) {
+			return true
+		}
+	}
+	return false
+}
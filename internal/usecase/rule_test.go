@@ -0,0 +1,153 @@
+package usecase
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/lucianocarvalho/labelify/internal/domain"
+)
+
+func TestEnrichmentUseCase_Execute_RuleMatching(t *testing.T) {
+	createResponse := func(metrics ...map[string]string) domain.QueryResponse {
+		response := domain.QueryResponse{
+			Status: "success",
+			Data: domain.QueryData{
+				ResultType: "vector",
+			},
+		}
+		for _, metric := range metrics {
+			response.Data.Result = append(response.Data.Result, domain.MetricData{
+				Metric: metric,
+				Value:  []interface{}{float64(182778586), "1"},
+			})
+		}
+		return response
+	}
+
+	createUseCase := func(metric string) *EnrichmentUseCase {
+		config := &domain.Config{
+			Sources: []domain.Source{
+				{
+					Name: "just-a-random-source",
+					Type: "yaml",
+					Mappings: domain.Mappings{
+						{
+							Pattern: "microservice-.*",
+							SourceData: domain.SourceData{
+								Labels: map[string]string{
+									"team": "engineering",
+								},
+							},
+						},
+					},
+				},
+			},
+			Enrichment: domain.Enrichment{
+				Rules: []domain.EnrichmentRule{
+					{
+						Match:      domain.MatchRule{Metric: metric, Label: "deployment"},
+						EnrichFrom: "just-a-random-source",
+						AddLabels:  domain.AddLabels{{Name: "team"}},
+						Mode:       domain.EnrichmentModeKeep,
+					},
+				},
+			},
+		}
+
+		uc, err := NewEnrichmentUseCase(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return uc
+	}
+
+	enriched := map[string]string{"deployment": "microservice-1", "team": "engineering"}
+
+	testCases := []struct {
+		name     string
+		metric   string
+		query    string
+		series   map[string]string
+		expected map[string]string
+	}{
+		{
+			name:     "an exact metric name used in the query",
+			metric:   "http_requests_total",
+			query:    "sum(rate(http_requests_total[5m])) by (deployment)",
+			series:   map[string]string{"deployment": "microservice-1"},
+			expected: enriched,
+		},
+		{
+			name:     "an exact metric name that is only a prefix of the queried metric",
+			metric:   "http_requests_total",
+			query:    "sum(rate(http_requests_total_bucket[5m])) by (deployment)",
+			series:   map[string]string{"deployment": "microservice-1"},
+			expected: map[string]string{"deployment": "microservice-1"},
+		},
+		{
+			name:     "an exact metric name that only shows up in a label value",
+			metric:   "http_requests_total",
+			query:    `sum(up{job="http_requests_total"}) by (deployment)`,
+			series:   map[string]string{"deployment": "microservice-1"},
+			expected: map[string]string{"deployment": "microservice-1"},
+		},
+		{
+			name:     "a regex on the metric name",
+			metric:   "kube_deployment_.*",
+			query:    "sum(kube_deployment_spec_replicas) by (deployment)",
+			series:   map[string]string{"deployment": "microservice-1"},
+			expected: enriched,
+		},
+		{
+			name:     "a label matcher pinned by the query",
+			metric:   `http_requests_total{job="api"}`,
+			query:    `sum(http_requests_total{job="api"}) by (deployment)`,
+			series:   map[string]string{"deployment": "microservice-1"},
+			expected: enriched,
+		},
+		{
+			name:     "a label matcher filtered out by the query",
+			metric:   `http_requests_total{job="api"}`,
+			query:    `sum(http_requests_total{job="web"}) by (deployment)`,
+			series:   map[string]string{"deployment": "microservice-1"},
+			expected: map[string]string{"deployment": "microservice-1"},
+		},
+		{
+			name:     "a label matcher checked on each series",
+			metric:   `http_requests_total{job="api"}`,
+			query:    `sum(http_requests_total) by (deployment, job)`,
+			series:   map[string]string{"deployment": "microservice-1", "job": "web"},
+			expected: map[string]string{"deployment": "microservice-1", "job": "web"},
+		},
+		{
+			name:     "a metric only used on the right side of a one-to-one join",
+			metric:   "kube_deployment_spec_replicas",
+			query:    "up * on(deployment) kube_deployment_spec_replicas",
+			series:   map[string]string{"deployment": "microservice-1"},
+			expected: map[string]string{"deployment": "microservice-1"},
+		},
+		{
+			name:     "a metric on the other side of an or",
+			metric:   "kube_deployment_spec_replicas",
+			query:    "up or kube_deployment_spec_replicas",
+			series:   map[string]string{"__name__": "up", "deployment": "microservice-1"},
+			expected: map[string]string{"__name__": "up", "deployment": "microservice-1"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run("given a rule matching "+tc.name, func(t *testing.T) {
+			response := createResponse(tc.series)
+
+			if err := createUseCase(tc.metric).Execute(&response, domain.QueryRequest{Query: tc.query}); err != nil {
+				t.Fatal(err)
+			}
+
+			t.Run("then it should only enrich the series selected by the rule", func(t *testing.T) {
+				if !reflect.DeepEqual(response.Data.Result[0].Metric, tc.expected) {
+					t.Fatalf("expected %+v, got %+v", tc.expected, response.Data.Result[0].Metric)
+				}
+			})
+		})
+	}
+}
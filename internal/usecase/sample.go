@@ -0,0 +1,20 @@
+package usecase
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Prometheus encodes sample values as strings, including "NaN", "+Inf" and
+// "-Inf", which strconv handles the same way.
+func parseSampleValue(value interface{}) (float64, error) {
+	s, ok := value.(string)
+	if !ok {
+		return 0, fmt.Errorf("expected a string, got %v", value)
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+func formatSampleValue(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
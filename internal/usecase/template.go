@@ -0,0 +1,136 @@
+package usecase
+
+import (
+	"bytes"
+	"log"
+	"text/template"
+	"text/template/parse"
+
+	"github.com/lucianocarvalho/labelify/internal/domain"
+)
+
+// labelTemplate is the value of an enriched label computed from the series
+// labels (eg: `{{ .namespace }}`) and the matched mapping labels (eg:
+// `{{ .Mapping.team }}`).
+type labelTemplate struct {
+	text     string
+	template *template.Template
+	// Whether the value is made of text only, thus known in advance.
+	static bool
+	// Series labels the value is computed from.
+	labels []string
+	// Mapping labels the value is computed from.
+	mappingLabels []string
+}
+
+func compileTemplate(name, text string) (*labelTemplate, error) {
+	tmpl, err := domain.ParseTemplate(name, text)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &labelTemplate{text: text, template: tmpl, static: true}
+	if tmpl.Tree != nil {
+		t.walk(tmpl.Tree.Root)
+	}
+	return t, nil
+}
+
+func (t *labelTemplate) walk(node parse.Node) {
+	switch n := node.(type) {
+	case *parse.TextNode:
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			t.walk(child)
+		}
+	case *parse.ActionNode:
+		t.static = false
+		t.walk(n.Pipe)
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+		for _, cmd := range n.Cmds {
+			t.walk(cmd)
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			t.walk(arg)
+		}
+	case *parse.FieldNode:
+		switch {
+		case len(n.Ident) == 0:
+		case n.Ident[0] != "Mapping":
+			t.labels = append(t.labels, n.Ident[0])
+		case len(n.Ident) > 1:
+			t.mappingLabels = append(t.mappingLabels, n.Ident[1])
+		}
+	case *parse.IfNode:
+		t.walkBranch(&n.BranchNode)
+	case *parse.RangeNode:
+		t.walkBranch(&n.BranchNode)
+	case *parse.WithNode:
+		t.walkBranch(&n.BranchNode)
+	default:
+		t.static = false
+	}
+}
+
+func (t *labelTemplate) walkBranch(n *parse.BranchNode) {
+	t.static = false
+	t.walk(n.Pipe)
+	t.walk(n.List)
+	t.walk(n.ElseList)
+}
+
+// render returns the value of the label, empty when it can't be computed.
+func (t *labelTemplate) render(data map[string]interface{}) string {
+	if t.static {
+		return t.text
+	}
+
+	var buf bytes.Buffer
+	if err := t.template.Execute(&buf, data); err != nil {
+		log.Printf("Error rendering template %s: %v", t.template.Name(), err)
+		return ""
+	}
+	return buf.String()
+}
+
+// templateData exposes the series labels, as they were before being
+// enriched, along with the labels of the matched mapping, if any. The
+// labels the templates reference are empty when missing, as in PromQL.
+func templateData(metric, mapping map[string]string, templates map[string]*labelTemplate) map[string]interface{} {
+	if len(templates) == 0 {
+		return nil
+	}
+
+	data := make(map[string]interface{}, len(metric)+1)
+	for name, value := range metric {
+		data[name] = value
+	}
+
+	mappingData := make(map[string]string, len(mapping))
+	for name, value := range mapping {
+		mappingData[name] = value
+	}
+
+	for _, t := range templates {
+		for _, name := range t.labels {
+			if _, ok := data[name]; !ok {
+				data[name] = ""
+			}
+		}
+		for _, name := range t.mappingLabels {
+			if _, ok := mappingData[name]; !ok {
+				mappingData[name] = ""
+			}
+		}
+	}
+	data["Mapping"] = mappingData
+
+	return data
+}
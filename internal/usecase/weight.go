@@ -0,0 +1,104 @@
+package usecase
+
+import (
+	"log"
+	"maps"
+
+	"github.com/lucianocarvalho/labelify/internal/domain"
+)
+
+// weighted takes the weights of the targets of a mapping from the source
+// the mappings are weighted from, if any: the mapping the same value
+// matches there gives the weights, its targets being paired by labels.
+func (h *EnrichmentUseCase) weighted(index *mappingIndex, value string, metric map[string]string, data *domain.SourceData) *domain.SourceData {
+	if index.weightsFrom == "" || len(data.Targets) == 0 {
+		return data
+	}
+
+	weightsIndex, err := h.mappingIndex(index.weightsFrom)
+	if err != nil {
+		log.Printf("Error indexing weights: %v", err)
+		return data
+	}
+
+	weights := weightsIndex.lookupSeries(value, metric)
+	if weights == nil {
+		return data
+	}
+
+	weighted := *data
+	weighted.Targets = make([]domain.Target, len(data.Targets))
+	for i, target := range data.Targets {
+		weighted.Targets[i] = target
+		for _, w := range weights.Targets {
+			if w.Weight != nil && maps.Equal(w.Labels, target.Labels) {
+				weighted.Targets[i].Weight = w.Weight
+				break
+			}
+		}
+	}
+	return &weighted
+}
+
+func hasWeights(data *domain.SourceData) bool {
+	if data == nil {
+		return false
+	}
+	for _, target := range data.Targets {
+		if target.Weight != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// scaleSeries returns the series with its values multiplied by weight.
+// Samples that can't be parsed are left as they are.
+func scaleSeries(r domain.MetricData, weight float64) domain.MetricData {
+	if r.Value != nil {
+		r.Value = scaleSample(r.Value, weight)
+	}
+	if r.Values != nil {
+		values := make([][]interface{}, len(r.Values))
+		for i, sample := range r.Values {
+			values[i] = scaleSample(sample, weight)
+		}
+		r.Values = values
+	}
+	if r.Histogram != nil {
+		r.Histogram = scaleHistogramSample(r.Histogram, weight)
+	}
+	if r.Histograms != nil {
+		histograms := make([][]interface{}, len(r.Histograms))
+		for i, sample := range r.Histograms {
+			histograms[i] = scaleHistogramSample(sample, weight)
+		}
+		r.Histograms = histograms
+	}
+	return r
+}
+
+func scaleSample(sample []interface{}, weight float64) []interface{} {
+	if len(sample) != 2 {
+		return sample
+	}
+
+	value, err := parseSampleValue(sample[1])
+	if err != nil {
+		return sample
+	}
+	return []interface{}{sample[0], formatSampleValue(value * weight)}
+}
+
+func scaleHistogramSample(sample []interface{}, weight float64) []interface{} {
+	if len(sample) != 2 {
+		return sample
+	}
+
+	h, err := parseHistogram(sample[1])
+	if err != nil {
+		return sample
+	}
+	h.scale(weight)
+	return []interface{}{sample[0], h.format()}
+}